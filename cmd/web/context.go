@@ -6,4 +6,5 @@ const (
 	isAuthenticatedContextKey = contextKey("isAuthenticated")
 	authenticatedUserIDKey    = contextKey("authenticatedUserID")
 	userRoleContextKey        = contextKey("userRole")
+	kioskContextKey           = contextKey("kiosk")
 )
@@ -2,8 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/a-h/templ"
@@ -175,22 +178,55 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) bookList(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("q")
+	isLibrarian := app.isLibrarian(r)
+	// only staff can see withdrawn books
+	withdrawn := isLibrarian && r.URL.Query().Get("withdrawn") == "1"
+	// only staff filter by item type
+	itemTypeID := 0
+	if isLibrarian {
+		itemTypeID, _ = strconv.Atoi(r.URL.Query().Get("type"))
+	}
 	var books []*models.Book
 	var err error
 
 	if query != "" {
-		books, err = app.books.Search(query)
+		books, err = app.books.Search(query, withdrawn, itemTypeID)
 	} else {
-		books, err = app.books.List()
+		books, err = app.books.List(withdrawn, itemTypeID)
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	availability, err := app.branches.Availability()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	reserves, err := app.reserves.ByBook()
+	if err != nil {
+		app.serverError(w, err)
+		return
 	}
+	itemTypes, err := app.itemTypes.List()
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	isLibrarian := app.isLibrarian(r)
 	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
-		return pages.BookListPage(books, query, flash, isAuthenticated, isLibrarian, csrfToken)
+		return pages.BookListPage(pages.BookListParams{
+			Books:        books,
+			Availability: availability,
+			Reserves:     reserves,
+			ItemTypes:    itemTypes,
+			ItemTypeID:   itemTypeID,
+			Query:        query,
+			Withdrawn:    withdrawn,
+			IsLibrarian:  isLibrarian,
+			IsAdmin:      app.isAdmin(r),
+			CSRFToken:    csrfToken,
+		}, flash, isAuthenticated)
 	})
 }
 
@@ -199,13 +235,14 @@ type bookForm struct {
 	Author              string `form:"author"`
 	ISBN                string `form:"isbn"`
 	Copies              string `form:"copies"`
+	ReplacementCost     string `form:"replacement_cost"`
+	BranchID            int    `form:"branch_id"`
+	ItemTypeID          int    `form:"item_type_id"`
 	validator.Validator `form:"-"`
 }
 
 func (app *application) bookCreateForm(w http.ResponseWriter, r *http.Request) {
-	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
-		return pages.BookFormPage(pages.BookFormParams{CSRFToken: csrfToken}, flash, isAuthenticated)
-	})
+	app.renderBookForm(w, r, pages.BookFormParams{})
 }
 
 func (app *application) bookCreatePost(w http.ResponseWriter, r *http.Request) {
@@ -220,28 +257,48 @@ func (app *application) bookCreatePost(w http.ResponseWriter, r *http.Request) {
 	form.CheckField(validator.NotBlank(form.Author), "author", "Author cannot be blank")
 	form.CheckField(validator.NotBlank(form.ISBN), "isbn", "ISBN cannot be blank")
 
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	form.CheckField(hasBranch(branches, form.BranchID), "branch_id", "Choose a branch you manage")
+	itemTypes, err := app.itemTypes.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	form.CheckField(hasItemType(itemTypes, form.ItemTypeID), "item_type_id", "Choose an item type")
+
 	copies, err := strconv.Atoi(form.Copies)
 	if err != nil || copies < 1 {
 		form.AddFieldError("copies", "Must be a number >= 1")
 	}
+	replacementCost := 0
+	if strings.TrimSpace(form.ReplacementCost) != "" {
+		replacementCost, err = parseCents(form.ReplacementCost)
+		if err != nil || replacementCost < 0 {
+			form.AddFieldError("replacement_cost", "Enter an amount, e.g. 25.00")
+		}
+	}
 
 	props := pages.BookFormParams{
-		Title:       form.Title,
-		Author:      form.Author,
-		ISBN:        form.ISBN,
-		Copies:      form.Copies,
-		FieldErrors: form.FieldErrors,
+		Title:           form.Title,
+		Author:          form.Author,
+		ISBN:            form.ISBN,
+		Copies:          form.Copies,
+		ReplacementCost: form.ReplacementCost,
+		BranchID:        form.BranchID,
+		ItemTypeID:      form.ItemTypeID,
+		FieldErrors:     form.FieldErrors,
 	}
 
 	if !form.Valid() {
-		app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
-			props.CSRFToken = csrfToken
-			return pages.BookFormPage(props, flash, isAuthenticated)
-		})
+		app.renderBookForm(w, r, props)
 		return
 	}
 
-	_, err = app.books.Insert(form.Title, form.Author, form.ISBN, copies)
+	_, err = app.books.Insert(form.Title, form.Author, form.ISBN, copies, replacementCost, form.BranchID, form.ItemTypeID)
 	if err != nil {
 		app.serverError(w, err)
 		return
@@ -251,153 +308,3732 @@ func (app *application) bookCreatePost(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/books", http.StatusSeeOther)
 }
 
-func (app *application) bookDeletePost(w http.ResponseWriter, r *http.Request) {
+// renderBookForm shows the add book form. New copies go to the librarian's
+// working branch unless they pick another they manage.
+func (app *application) renderBookForm(w http.ResponseWriter, r *http.Request, props pages.BookFormParams) {
+	var err error
+	props.Branches, err = app.staffBranches(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if props.BranchID == 0 {
+		props.BranchID, err = app.workingBranch(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	props.ItemTypes, err = app.itemTypes.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if props.ItemTypeID == 0 {
+		props.ItemTypeID = models.DefaultItemTypeID
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.BookFormPage(props, flash, isAuthenticated)
+	})
+}
+
+func (app *application) bookWithdrawPost(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.notFound(w)
 		return
 	}
-	err = app.books.Delete(id)
+	ok, err := app.managesBook(r, id)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	app.sessionManager.Put(r.Context(), "flash", "Book removed.")
+	if !ok {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+	err = app.books.Withdraw(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrBookOnLoan):
+			app.sessionManager.Put(r.Context(), "flash", "That book still has copies on loan. Check them in before withdrawing it.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Book withdrawn. Its loan history has been kept.")
 	http.Redirect(w, r, "/books", http.StatusSeeOther)
 }
 
-// --- issues ---
+func (app *application) bookRestorePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	ok, err := app.managesBook(r, id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !ok {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+	err = app.books.Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrNotWithdrawn):
+			app.sessionManager.Put(r.Context(), "flash", "That book is already in the catalogue.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Book restored to the catalogue.")
+	http.Redirect(w, r, "/books?withdrawn=1", http.StatusSeeOther)
+}
 
-func (app *application) issueBookPost(w http.ResponseWriter, r *http.Request) {
+func (app *application) adminBookPurgePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	err = app.books.Purge(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrNotWithdrawn):
+			app.sessionManager.Put(r.Context(), "flash", "Withdraw the book before purging it.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBookHasHistory):
+			app.sessionManager.Put(r.Context(), "flash", "That book has been lent before, so it can't be purged. It stays withdrawn.")
+			http.Redirect(w, r, "/books?withdrawn=1", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Book purged.")
+	http.Redirect(w, r, "/books?withdrawn=1", http.StatusSeeOther)
+}
+
+// --- copies ---
+
+type copyForm struct {
+	Barcode             string `form:"barcode"`
+	BranchID            int    `form:"branch_id"`
+	Location            string `form:"location"`
+	Status              string `form:"status"`
+	ReplacementCost     string `form:"replacement_cost"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) bookCopies(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderCopies(w, r, id, pages.CopyFormParams{})
+}
+
+func (app *application) bookCopyAddPost(w http.ResponseWriter, r *http.Request) {
 	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.notFound(w)
 		return
 	}
 
-	book, err := app.books.Get(bookID)
+	var form copyForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Barcode = strings.TrimSpace(form.Barcode)
+	form.Location = strings.TrimSpace(form.Location)
+	form.CheckField(validator.MaxChars(form.Barcode, 32), "barcode", "This field cannot be more than 32 characters long")
+	form.CheckField(validator.MaxChars(form.Location, 100), "location", "This field cannot be more than 100 characters long")
+	branches, err := app.staffBranches(r)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	if book.AvailableCopies < 1 {
-		app.sessionManager.Put(r.Context(), "flash", "No copies available right now.")
-		http.Redirect(w, r, "/books", http.StatusSeeOther)
+	form.CheckField(hasBranch(branches, form.BranchID), "branch_id", "Choose a branch you manage")
+
+	if form.Valid() {
+		_, err = app.copies.Add(bookID, form.BranchID, form.Barcode, form.Location)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Copy added.")
+			http.Redirect(w, r, fmt.Sprintf("/books/%d/copies", bookID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+			return
+		case errors.Is(err, models.ErrDuplicateBarcode):
+			form.AddFieldError("barcode", "This barcode is already on another copy")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderCopies(w, r, bookID, pages.CopyFormParams{
+		Barcode:     form.Barcode,
+		BranchID:    form.BranchID,
+		Location:    form.Location,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+func (app *application) copyUpdatePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	c, err := app.copies.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
 		return
 	}
 
-	userID := app.getUserID(r)
-	_, err = app.issues.GetActiveIssue(bookID, userID)
-	if err == nil {
-		// already has active issue
-		app.sessionManager.Put(r.Context(), "flash", "You already have this book issued.")
-		http.Redirect(w, r, "/books", http.StatusSeeOther)
+	var form copyForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
+	form.Location = strings.TrimSpace(form.Location)
+	redirect := fmt.Sprintf("/books/%d/copies", c.BookID)
 
-	dueDate := time.Now().AddDate(0, 0, 14) // 2 week due
-	_, err = app.issues.Issue(bookID, userID, dueDate)
+	branches, err := app.staffBranches(r)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	err = app.books.DecrementAvailable(bookID)
-	if err != nil {
+	if !hasBranch(branches, c.BranchID) {
+		app.sessionManager.Put(r.Context(), "flash", "Copy "+c.Barcode+" belongs to "+c.BranchName+", which you don't manage.")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if !validator.MaxChars(form.Location, 100) {
+		app.sessionManager.Put(r.Context(), "flash", "Shelf location cannot be more than 100 characters long.")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if form.Status != c.Status && !validator.PermittedValue(form.Status, models.CopyStaffStatuses...) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	// a blank cost means the copy uses the book's
+	var replacementCost *int
+	if strings.TrimSpace(form.ReplacementCost) != "" {
+		cents, err := parseCents(form.ReplacementCost)
+		if err != nil || cents < 0 {
+			app.sessionManager.Put(r.Context(), "flash", "Replacement cost must be an amount, e.g. 25.00.")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		replacementCost = &cents
+	}
+
+	err = app.copies.Update(id, form.Location, form.Status, replacementCost)
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "Copy "+c.Barcode+" updated.")
+	case errors.Is(err, models.ErrCopyInUse):
+		app.sessionManager.Put(r.Context(), "flash", "Copy "+c.Barcode+" is on loan, held for a patron or in transit; check it in, cancel the hold or receive it first.")
+	default:
 		app.serverError(w, err)
 		return
 	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
 
-	app.sessionManager.Put(r.Context(), "flash", "Book issued! Due: "+dueDate.Format("02 Jan 2006"))
-	http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+type replacementCostForm struct {
+	ReplacementCost     string `form:"replacement_cost"`
+	validator.Validator `form:"-"`
 }
 
-func (app *application) returnBookPost(w http.ResponseWriter, r *http.Request) {
-	issueID, err := strconv.Atoi(chi.URLParam(r, "id"))
+func (app *application) bookReplacementCostPost(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.notFound(w)
 		return
 	}
-
-	userID := app.getUserID(r)
-	// get the issue first so we can increment available copies
-	activeIssues, err := app.issues.GetActiveByUser(userID)
+	ok, err := app.managesBook(r, bookID)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
+	if !ok {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	var form replacementCostForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	cents, err := parseCents(form.ReplacementCost)
+	if err != nil || cents < 0 {
+		form.AddFieldError("replacement_cost", "Enter an amount, e.g. 25.00")
+	}
 
-	var bookID int
-	for _, iss := range activeIssues {
-		if iss.ID == issueID {
-			bookID = iss.BookID
-			break
+	if form.Valid() {
+		err = app.books.SetReplacementCost(bookID, cents)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Replacement cost set to "+pages.Money(cents)+".")
+			http.Redirect(w, r, fmt.Sprintf("/books/%d/copies", bookID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+			return
+		default:
+			app.serverError(w, err)
+			return
 		}
 	}
 
-	if bookID == 0 {
+	app.renderCopies(w, r, bookID, pages.CopyFormParams{
+		ReplacementCost: form.ReplacementCost,
+		FieldErrors:     form.FieldErrors,
+	})
+}
+
+type itemTypeForm struct {
+	ItemTypeID int `form:"item_type_id"`
+}
+
+func (app *application) bookItemTypePost(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	ok, err := app.managesBook(r, bookID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !ok {
 		app.clientError(w, http.StatusForbidden)
 		return
 	}
 
-	err = app.issues.Return(issueID, userID)
+	var form itemTypeForm
+	err = app.decodePostForm(r, &form)
 	if err != nil {
-		app.serverError(w, err)
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
-	err = app.books.IncrementAvailable(bookID)
+	itemTypes, err := app.itemTypes.List()
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
+	if !hasItemType(itemTypes, form.ItemTypeID) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
 
-	app.sessionManager.Put(r.Context(), "flash", "Book returned successfully.")
-	http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+	err = app.books.SetItemType(bookID, form.ItemTypeID)
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "Item type updated.")
+		http.Redirect(w, r, fmt.Sprintf("/books/%d/copies", bookID), http.StatusSeeOther)
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+	default:
+		app.serverError(w, err)
+	}
 }
 
-func (app *application) myBooks(w http.ResponseWriter, r *http.Request) {
-	userID := app.getUserID(r)
-	issues, err := app.issues.GetActiveByUser(userID)
+func (app *application) renderCopies(w http.ResponseWriter, r *http.Request, bookID int, props pages.CopyFormParams) {
+	book, err := app.books.Get(bookID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	copies, err := app.copies.GetByBook(bookID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Book = book
+	props.Copies = copies
+	props.Branches, err = app.staffBranches(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if props.BranchID == 0 {
+		props.BranchID, err = app.workingBranch(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	if props.ReplacementCost == "" {
+		props.ReplacementCost = pages.Money(book.ReplacementCost)
+	}
+	props.ItemTypes, err = app.itemTypes.List()
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
-		return pages.MyBooksPage(issues, flash, isAuthenticated, csrfToken)
+		props.CSRFToken = csrfToken
+		return pages.CopiesPage(props, flash, isAuthenticated)
 	})
 }
 
-// --- admin ---
+// --- course reserves ---
 
-func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.users.ListUsers()
+// reserveLoanHours are the short loan periods offered for course reserves;
+// 0 is overnight.
+var reserveLoanHours = []int{2, 4, 24, 0}
+
+func (app *application) reserveList(w http.ResponseWriter, r *http.Request) {
+	app.renderReserves(w, r, pages.ReservesParams{LoanHours: "4"})
+}
+
+type reserveForm struct {
+	CourseCode          string `form:"course_code"`
+	Instructor          string `form:"instructor"`
+	Term                string `form:"term"`
+	EndsOn              string `form:"ends_on"`
+	LoanHours           string `form:"loan_hours"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) reservePost(w http.ResponseWriter, r *http.Request) {
+	var form reserveForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// "cs 101" and "CS101" are the same course
+	form.CourseCode = strings.ToUpper(strings.Join(strings.Fields(form.CourseCode), ""))
+	form.Instructor = strings.TrimSpace(form.Instructor)
+	form.Term = strings.TrimSpace(form.Term)
+	form.CheckField(validator.NotBlank(form.CourseCode), "course_code", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.CourseCode, 20), "course_code", "This field cannot be more than 20 characters long")
+	form.CheckField(validator.NotBlank(form.Instructor), "instructor", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Instructor, 255), "instructor", "This field cannot be more than 255 characters long")
+	form.CheckField(validator.NotBlank(form.Term), "term", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Term, 50), "term", "This field cannot be more than 50 characters long")
+	endsOn, err := time.Parse("2006-01-02", form.EndsOn)
+	if err != nil {
+		form.AddFieldError("ends_on", "Enter the last day of term")
+	} else if endsOn.Before(time.Now().AddDate(0, 0, -1)) {
+		form.AddFieldError("ends_on", "The term has already ended")
+	}
+	loanHours, err := strconv.Atoi(form.LoanHours)
+	form.CheckField(err == nil && slices.Contains(reserveLoanHours, loanHours), "loan_hours", "Choose a loan period")
+
+	if !form.Valid() {
+		app.renderReserves(w, r, pages.ReservesParams{
+			CourseCode:  form.CourseCode,
+			Instructor:  form.Instructor,
+			Term:        form.Term,
+			EndsOn:      form.EndsOn,
+			LoanHours:   form.LoanHours,
+			FieldErrors: form.FieldErrors,
+		})
+		return
+	}
+
+	id, err := app.reserves.Insert(form.CourseCode, form.Instructor, form.Term, endsOn, loanHours)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Reserve created. Add the books for "+form.CourseCode+".")
+	http.Redirect(w, r, fmt.Sprintf("/reserves/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) renderReserves(w http.ResponseWriter, r *http.Request, props pages.ReservesParams) {
+	props.IsLibrarian = app.isLibrarian(r)
+	// only staff can see expired reserves
+	props.Expired = props.IsLibrarian && r.URL.Query().Get("expired") == "1"
+	props.LoanHourOptions = reserveLoanHours
+	var err error
+	props.Reserves, err = app.reserves.List(props.Expired)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
-		return pages.AdminUsersPage(users, flash, isAuthenticated, csrfToken)
+		props.CSRFToken = csrfToken
+		return pages.ReservesPage(props, flash, isAuthenticated)
 	})
 }
 
-func (app *application) adminPromotePost(w http.ResponseWriter, r *http.Request) {
+func (app *application) reserveView(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.notFound(w)
 		return
 	}
-	err = app.users.PromoteToLibrarian(id)
+	app.renderReserve(w, r, id, pages.ReserveParams{})
+}
+
+type reserveBookForm struct {
+	ISBN                string `form:"isbn"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) reserveBookPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		app.serverError(w, err)
+		app.notFound(w)
 		return
 	}
-	app.sessionManager.Put(r.Context(), "flash", "User promoted to librarian.")
-	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
-}
-
-// -- librarian issue management --
 
-func (app *application) allIssues(w http.ResponseWriter, r *http.Request) {
-	issues, err := app.issues.GetAll()
+	var form reserveBookForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	reserve, err := app.reserves.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	form.ISBN = strings.TrimSpace(form.ISBN)
+	form.CheckField(validator.NotBlank(form.ISBN), "isbn", "Enter the book's ISBN")
+	form.CheckField(!reserve.Expired(), "isbn", "This reserve's term has ended, so no more books can be added")
+
+	if form.Valid() {
+		book, err := app.books.GetByISBN(form.ISBN)
+		switch {
+		case err == nil && book.WithdrawnAt != nil:
+			form.AddFieldError("isbn", "That book has been withdrawn")
+		case err == nil:
+			err = app.reserves.AddBook(id, book.ID)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%q is now on reserve.", book.Title))
+			http.Redirect(w, r, fmt.Sprintf("/reserves/%d", id), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			form.AddFieldError("isbn", "No book with this ISBN")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderReserve(w, r, id, pages.ReserveParams{ISBN: form.ISBN, FieldErrors: form.FieldErrors})
+}
+
+func (app *application) reserveBookRemovePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	bookID, err := strconv.Atoi(chi.URLParam(r, "bookID"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.reserves.RemoveBook(id, bookID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Book taken off reserve.")
+	http.Redirect(w, r, fmt.Sprintf("/reserves/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) renderReserve(w http.ResponseWriter, r *http.Request, id int, props pages.ReserveParams) {
+	var err error
+	props.Reserve, err = app.reserves.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	props.IsLibrarian = app.isLibrarian(r)
+	// patrons don't see expired reserves, as the books are back on normal loan
+	if props.Reserve.Expired() && !props.IsLibrarian {
+		app.notFound(w)
+		return
+	}
+	props.Books, err = app.reserves.Books(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.ReservePage(props, flash, isAuthenticated)
+	})
+}
+
+// --- issues ---
+
+func (app *application) issueBookPost(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	issueID, _, err := app.issues.Issue(bookID, app.getUserID(r), 0, 0)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrNoCopiesAvailable):
+			app.sessionManager.Put(r.Context(), "flash", "No copies available right now.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBookWithdrawn):
+			app.sessionManager.Put(r.Context(), "flash", "That book has been withdrawn from the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrNotLoanable):
+			app.sessionManager.Put(r.Context(), "flash", "That book is for reference only and can't be borrowed. You can read it in the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrAlreadyIssued):
+			app.sessionManager.Put(r.Context(), "flash", "You already have this book issued.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrFinesOutstanding):
+			app.sessionManager.Put(r.Context(), "flash", "You have unpaid fines. Please settle them at the desk before borrowing more books.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrLoanLimitReached):
+			app.sessionManager.Put(r.Context(), "flash", "You've reached the maximum number of books you can borrow at once. Return one to borrow another.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBorrowingSuspended):
+			app.sessionManager.Put(r.Context(), "flash", "Your borrowing is suspended. Check your notices or ask at the library desk.")
+			http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+		case errors.Is(err, models.ErrMembershipExpired):
+			app.sessionManager.Put(r.Context(), "flash", "Your library membership has expired. Please renew it at the library desk.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrNoLoanPolicy):
+			app.sessionManager.Put(r.Context(), "flash", "Your account isn't set up for borrowing yet. Please contact the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	due, err := app.loanDue(issueID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Book issued! Due: "+due)
+	http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+}
+
+func (app *application) returnBookPost(w http.ResponseWriter, r *http.Request) {
+	issueID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.issues.Return(issueID, app.getUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusForbidden)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Book returned successfully.")
+	http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+}
+
+func (app *application) renewIssuePost(w http.ResponseWriter, r *http.Request) {
+	issueID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	_, err = app.issues.Renew(issueID, app.getUserID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.clientError(w, http.StatusForbidden)
+		case errors.Is(err, models.ErrRenewalLimitReached):
+			app.sessionManager.Put(r.Context(), "flash", "This loan has no renewals left.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrRenewalOverdue):
+			app.sessionManager.Put(r.Context(), "flash", "This loan is too far overdue to renew. Please return the book.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrHoldsPending):
+			app.sessionManager.Put(r.Context(), "flash", "Another reader is waiting for this book, so it can't be renewed.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrRecalled):
+			app.sessionManager.Put(r.Context(), "flash", "This book has been recalled, so it can't be renewed.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBorrowingSuspended):
+			app.sessionManager.Put(r.Context(), "flash", "Your borrowing is suspended, so loans can't be renewed. Check your notices or ask at the library desk.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrMembershipExpired):
+			app.sessionManager.Put(r.Context(), "flash", "Your library membership has expired, so loans can't be renewed. Please renew it at the library desk.")
+			http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	due, err := app.loanDue(issueID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Loan renewed! New due date: "+due)
+	http.Redirect(w, r, "/my-books", http.StatusSeeOther)
+}
+
+func (app *application) myBooks(w http.ResponseWriter, r *http.Request) {
+	userID := app.getUserID(r)
+	issues, err := app.issues.GetActiveByUser(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	fines, err := app.fines.GetByUser(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.users.GetUserInfo(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	branches, err := app.branches.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.MyBooksPage(issues, fines, branches, user.DefaultBranchID, flash, isAuthenticated, csrfToken)
+	})
+}
+
+// historyPageSize is how many returned loans the history page shows at once.
+const historyPageSize = 20
+
+func (app *application) myHistory(w http.ResponseWriter, r *http.Request) {
+	userID := app.getUserID(r)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	issues, total, err := app.issues.History(userID, query, page, historyPageSize)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	user, err := app.users.GetUserInfo(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.HistoryPage(pages.HistoryParams{
+			Issues:      issues,
+			Query:       query,
+			Page:        page,
+			TotalPages:  (total + historyPageSize - 1) / historyPageSize,
+			KeepHistory: user.KeepHistory,
+			CSRFToken:   csrfToken,
+		}, flash, isAuthenticated)
+	})
+}
+
+type historySettingsForm struct {
+	KeepHistory bool `form:"keep_history"`
+}
+
+func (app *application) myHistorySettingsPost(w http.ResponseWriter, r *http.Request) {
+	var form historySettingsForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.users.SetKeepHistory(app.getUserID(r), form.KeepHistory)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if form.KeepHistory {
+		app.sessionManager.Put(r.Context(), "flash", "Your borrowing history will be kept from now on.")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Borrowing history turned off. Your returned loans are no longer linked to your account.")
+	}
+	http.Redirect(w, r, "/my-books/history", http.StatusSeeOther)
+}
+
+type myBranchForm struct {
+	BranchID int    `form:"branch_id"`
+	Next     string `form:"next"`
+}
+
+// myBranchPost sets the user's default branch. For staff this is the branch
+// they are working at, so it must be one they can act for; patrons can pick
+// any branch, or none.
+func (app *application) myBranchPost(w http.ResponseWriter, r *http.Request) {
+	var form myBranchForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	if app.isLibrarian(r) {
+		branches, err := app.staffBranches(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !hasBranch(branches, form.BranchID) {
+			app.clientError(w, http.StatusForbidden)
+			return
+		}
+	}
+	if form.BranchID != 0 {
+		branch, err := app.branches.Get(form.BranchID)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				app.clientError(w, http.StatusBadRequest)
+			} else {
+				app.serverError(w, err)
+			}
+			return
+		}
+		name = branch.Name
+	}
+
+	err = app.users.SetDefaultBranch(app.getUserID(r), form.BranchID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if name != "" {
+		app.sessionManager.Put(r.Context(), "flash", "Your branch is now "+name+".")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Branch preference cleared.")
+	}
+
+	// only redirect within the site
+	next := "/my-books"
+	if isLocalPath(form.Next) {
+		next = form.Next
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// --- desk checkout ---
+
+func (app *application) deskSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var users []*models.User
+	if query != "" {
+		var err error
+		users, err = app.users.Search(query)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	picker, err := app.branchPicker(r, "/desk")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		picker.CSRFToken = csrfToken
+		return pages.DeskSearchPage(users, query, picker, flash, isAuthenticated)
+	})
+}
+
+type deskCheckoutForm struct {
+	Item                string `form:"item"`
+	validator.Validator `form:"-"`
+}
+
+type cardNumberForm struct {
+	CardNumber          string `form:"card_number"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) deskPatron(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderDeskPatron(w, r, id, pages.DeskPatronParams{})
+}
+
+func (app *application) deskCheckoutPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form deskCheckoutForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Item = strings.TrimSpace(form.Item)
+	form.CheckField(validator.NotBlank(form.Item), "item", "Scan the copy's barcode or enter an ISBN")
+
+	if form.Valid() {
+		title, due, err := app.deskIssue(r, form.Item, patronID)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Issued %q, due %s.", title, due))
+			http.Redirect(w, r, fmt.Sprintf("/desk/patrons/%d", patronID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			form.AddFieldError("item", "No copy with this barcode and no book with this ISBN")
+		case blockMessage(err) != "":
+			form.AddFieldError("item", blockMessage(err))
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderDeskPatron(w, r, patronID, pages.DeskPatronParams{
+		Item:        form.Item,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+// deskIssue issues the copy with the given barcode, or failing that any copy
+// of the book with the given ISBN, from the staff member's working branch. It
+// returns the book's title and when the loan is due.
+func (app *application) deskIssue(r *http.Request, item string, patronID int) (string, string, error) {
+	staffID := app.getUserID(r)
+	branchID, err := app.workingBranch(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	title := ""
+	var issueID int
+	c, err := app.copies.GetByBarcode(item)
+	if err == nil {
+		title = c.BookTitle
+		issueID, _, err = app.issues.IssueCopy(c.ID, patronID, staffID, branchID)
+	} else if errors.Is(err, models.ErrNoRecord) {
+		var book *models.Book
+		book, err = app.books.GetByISBN(item)
+		if err != nil {
+			return "", "", err
+		}
+		title = book.Title
+		issueID, _, err = app.issues.Issue(book.ID, patronID, staffID, branchID)
+	}
+	if err != nil {
+		return title, "", err
+	}
+	due, err := app.loanDue(issueID)
+	return title, due, err
+}
+
+func (app *application) deskCardNumberPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form cardNumberForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CardNumber = strings.TrimSpace(form.CardNumber)
+	form.CheckField(validator.MaxChars(form.CardNumber, 32), "card_number", "This field cannot be more than 32 characters long")
+
+	if form.Valid() {
+		err = app.users.SetCardNumber(patronID, form.CardNumber)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Library card updated.")
+			http.Redirect(w, r, fmt.Sprintf("/desk/patrons/%d", patronID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrDuplicateCardNumber):
+			form.AddFieldError("card_number", "This card number belongs to another patron")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderDeskPatron(w, r, patronID, pages.DeskPatronParams{
+		CardNumber:  form.CardNumber,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type pinForm struct {
+	PIN                 string `form:"pin"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) deskPINPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form pinForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CheckField(form.PIN == "" || validator.Matches(form.PIN, validator.PINRX), "pin", "The PIN must be 4 to 8 digits")
+
+	if form.Valid() {
+		err = app.users.SetPIN(patronID, form.PIN)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if form.PIN == "" {
+			app.sessionManager.Put(r.Context(), "flash", "Kiosk PIN removed.")
+		} else {
+			app.sessionManager.Put(r.Context(), "flash", "Kiosk PIN set.")
+		}
+		http.Redirect(w, r, fmt.Sprintf("/desk/patrons/%d", patronID), http.StatusSeeOther)
+		return
+	}
+
+	app.renderDeskPatron(w, r, patronID, pages.DeskPatronParams{FieldErrors: form.FieldErrors})
+}
+
+func (app *application) deskMembershipPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.users.RenewMembership(patronID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Membership renewed.")
+	http.Redirect(w, r, fmt.Sprintf("/desk/patrons/%d", patronID), http.StatusSeeOther)
+}
+
+type blockForm struct {
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) deskBlockPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form blockForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Reason = strings.TrimSpace(form.Reason)
+	form.CheckField(validator.NotBlank(form.Reason), "reason", "Give a reason for the block")
+	form.CheckField(validator.MaxChars(form.Reason, 255), "reason", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		exists, err := app.users.Exists(patronID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !exists {
+			app.notFound(w)
+			return
+		}
+		_, err = app.blocks.Add(patronID, app.getUserID(r), form.Reason)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Patron blocked.")
+		http.Redirect(w, r, fmt.Sprintf("/desk/patrons/%d", patronID), http.StatusSeeOther)
+		return
+	}
+
+	app.renderDeskPatron(w, r, patronID, pages.DeskPatronParams{
+		Reason:      form.Reason,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type liftBlockForm struct {
+	Next string `form:"next"`
+}
+
+// deskLiftBlockPost lifts a block from the desk or patron account page and
+// goes back to the page it came from.
+func (app *application) deskLiftBlockPost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	blockID, err := strconv.Atoi(chi.URLParam(r, "blockID"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form liftBlockForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	next := fmt.Sprintf("/desk/patrons/%d", patronID)
+	if isLocalPath(form.Next) {
+		next = form.Next
+	}
+
+	err = app.blocks.Lift(blockID, patronID, app.getUserID(r))
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "Block lifted.")
+	case errors.Is(err, models.ErrNoRecord):
+		app.sessionManager.Put(r.Context(), "flash", "That block has already been lifted.")
+	default:
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (app *application) renderDeskPatron(w http.ResponseWriter, r *http.Request, patronID int, props pages.DeskPatronParams) {
+	patron, err := app.users.GetUserInfo(patronID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	issues, err := app.issues.GetActiveByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	fines, err := app.fines.GetByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	blocks, err := app.issues.Blocks(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	suspensions, err := app.blocks.GetActive(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	props.Patron = patron
+	props.Issues = issues
+	props.Fines = fines
+	props.Suspensions = suspensions
+	for _, b := range blocks {
+		props.Blocks = append(props.Blocks, blockMessage(b))
+	}
+	if props.CardNumber == "" {
+		props.CardNumber = patron.CardNumber
+	}
+
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.DeskPatronPage(props, flash, isAuthenticated)
+	})
+}
+
+// --- patron accounts ---
+
+// patronHistorySize is how many returned loans the patron account page shows.
+const patronHistorySize = 20
+
+func (app *application) patronView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderPatron(w, r, id, pages.PatronParams{})
+}
+
+func (app *application) patronCheckInPost(w http.ResponseWriter, r *http.Request) {
+	patronID, issueID, ok := app.patronLoanParams(w, r)
+	if !ok {
+		return
+	}
+
+	branchID, err := app.workingBranch(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.issues.CheckIn(issueID, app.getUserID(r), branchID, time.Now(), "")
+	switch {
+	case err == nil:
+		flash, err := app.checkedInFlash(issueID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+	case errors.Is(err, models.ErrNoRecord):
+		app.sessionManager.Put(r.Context(), "flash", "That loan has already been returned.")
+	default:
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+}
+
+func (app *application) patronRenewPost(w http.ResponseWriter, r *http.Request) {
+	patronID, issueID, ok := app.patronLoanParams(w, r)
+	if !ok {
+		return
+	}
+
+	// the loan is renewed as if the patron had asked, so the usual rules apply
+	_, err := app.issues.Renew(issueID, patronID)
+	switch {
+	case err == nil:
+		due, err := app.loanDue(issueID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Loan renewed, now due "+due+".")
+	case errors.Is(err, models.ErrNoRecord):
+		app.sessionManager.Put(r.Context(), "flash", "That loan has already been returned.")
+	case renewalRefusal(err) != "":
+		app.sessionManager.Put(r.Context(), "flash", "Can't renew: "+renewalRefusal(err)+".")
+	default:
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+}
+
+// patronLoanParams reads the patron and loan IDs from the URL, answering
+// with a 404 unless the loan is the patron's.
+func (app *application) patronLoanParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return 0, 0, false
+	}
+	issueID, err := strconv.Atoi(chi.URLParam(r, "issueID"))
+	if err != nil {
+		app.notFound(w)
+		return 0, 0, false
+	}
+	issue, err := app.issues.Get(issueID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return 0, 0, false
+	}
+	if issue.UserID != patronID {
+		app.notFound(w)
+		return 0, 0, false
+	}
+	return patronID, issueID, true
+}
+
+type waiveForm struct {
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
+// patronWaivePost waives whatever is still owed on one of the patron's fines.
+func (app *application) patronWaivePost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	fineID, err := strconv.Atoi(chi.URLParam(r, "fineID"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form waiveForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Reason = strings.TrimSpace(form.Reason)
+	form.CheckField(validator.NotBlank(form.Reason), "reason", "A waiver needs a reason")
+	form.CheckField(validator.MaxChars(form.Reason, 255), "reason", "This field cannot be more than 255 characters long")
+
+	fine, err := app.fines.Get(fineID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if fine.UserID != patronID {
+		app.notFound(w)
+		return
+	}
+
+	if form.Valid() {
+		amount := fine.Outstanding()
+		if amount <= 0 {
+			app.sessionManager.Put(r.Context(), "flash", "That fine has already been settled.")
+			http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+			return
+		}
+		err = app.fines.Waive(fineID, app.getUserID(r), amount, form.Reason)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Waived "+pages.Money(amount)+".")
+		case errors.Is(err, models.ErrExceedsBalance):
+			// a payment came in since the page was loaded
+			app.sessionManager.Put(r.Context(), "flash", "That fine changed while you were looking at it. Check it and try again.")
+		default:
+			app.serverError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+		return
+	}
+
+	app.renderPatron(w, r, patronID, pages.PatronParams{
+		WaiveFineID: fineID,
+		WaiveReason: form.Reason,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type patronMessageForm struct {
+	Message             string `form:"message"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) patronMessagePost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form patronMessageForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Message = strings.TrimSpace(form.Message)
+	form.CheckField(validator.NotBlank(form.Message), "message", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Message, 500), "message", "This field cannot be more than 500 characters long")
+
+	if form.Valid() {
+		exists, err := app.users.Exists(patronID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !exists {
+			app.notFound(w)
+			return
+		}
+		err = app.notifications.Send(patronID, form.Message)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Message sent to the patron's notices.")
+		http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+		return
+	}
+
+	app.renderPatron(w, r, patronID, pages.PatronParams{
+		Message:     form.Message,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type patronNoteForm struct {
+	Note                string `form:"note"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) patronNotePost(w http.ResponseWriter, r *http.Request) {
+	patronID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form patronNoteForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Note = strings.TrimSpace(form.Note)
+	form.CheckField(validator.NotBlank(form.Note), "note", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Note, 1000), "note", "This field cannot be more than 1000 characters long")
+
+	if form.Valid() {
+		exists, err := app.users.Exists(patronID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !exists {
+			app.notFound(w)
+			return
+		}
+		_, err = app.patronNotes.Add(patronID, app.getUserID(r), form.Note)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Note added.")
+		http.Redirect(w, r, fmt.Sprintf("/patrons/%d", patronID), http.StatusSeeOther)
+		return
+	}
+
+	app.renderPatron(w, r, patronID, pages.PatronParams{
+		Note:        form.Note,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+func (app *application) renderPatron(w http.ResponseWriter, r *http.Request, patronID int, props pages.PatronParams) {
+	patron, err := app.users.GetUserInfo(patronID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	props.Patron = patron
+	props.Issues, err = app.issues.GetActiveByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.History, props.HistoryTotal, err = app.issues.History(patronID, "", 1, patronHistorySize)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Holds, err = app.holds.GetByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Fines, err = app.fines.GetByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Suspensions, err = app.blocks.GetActive(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Notes, err = app.patronNotes.GetByUser(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	blocks, err := app.issues.Blocks(patronID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	for _, b := range blocks {
+		props.Blocks = append(props.Blocks, blockMessage(b))
+	}
+
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.PatronPage(props, flash, isAuthenticated)
+	})
+}
+
+// --- circulation ---
+
+// circulationLogSize caps how many scans the circulation screen remembers.
+const circulationLogSize = 100
+
+func (app *application) circulation(w http.ResponseWriter, r *http.Request) {
+	props := pages.CirculationParams{Log: app.circulationLog(r)}
+	if id := app.sessionManager.GetInt(r.Context(), "circulationPatronID"); id != 0 {
+		var err error
+		props.Patron.Patron, props.Patron.Blocks, err = app.circulationPatron(id)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+	}
+	var err error
+	props.Branch, err = app.branchPicker(r, "/circulation")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		props.Branch.CSRFToken = csrfToken
+		return pages.CirculationPage(props, flash, isAuthenticated)
+	})
+}
+
+// circulationLog returns the scans made on the circulation screen this
+// session, newest first.
+func (app *application) circulationLog(r *http.Request) []pages.CirculationEntry {
+	log, _ := app.sessionManager.Get(r.Context(), "circulationLog").([]pages.CirculationEntry)
+	return log
+}
+
+// circulationPatron looks up the patron being served and why they can't
+// borrow, if they can't.
+func (app *application) circulationPatron(id int) (*models.User, []string, error) {
+	patron, err := app.users.GetUserInfo(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks, err := app.issues.Blocks(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msgs []string
+	for _, b := range blocks {
+		msgs = append(msgs, blockMessage(b))
+	}
+	return patron, msgs, nil
+}
+
+type circulationPatronForm struct {
+	CardNumber string `form:"card_number"`
+}
+
+// circulationPatronPost selects the patron whose card was scanned for the
+// check-outs that follow. It answers with the patron panel.
+func (app *application) circulationPatronPost(w http.ResponseWriter, r *http.Request) {
+	var form circulationPatronForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CardNumber = strings.TrimSpace(form.CardNumber)
+
+	var props pages.CirculationPatronParams
+	patron, err := app.users.GetByCardNumber(form.CardNumber)
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "circulationPatronID", patron.ID)
+		props.Patron, props.Blocks, err = app.circulationPatron(patron.ID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	case errors.Is(err, models.ErrNoRecord):
+		app.sessionManager.Remove(r.Context(), "circulationPatronID")
+		props.Error = fmt.Sprintf("No patron with card number %q", form.CardNumber)
+	default:
+		app.serverError(w, err)
+		return
+	}
+	app.renderFragment(w, r, pages.CirculationPatron(props))
+}
+
+type circulationItemForm struct {
+	Mode string `form:"mode"`
+	Item string `form:"item"`
+}
+
+// circulationItemPost checks a scanned item out to the current patron or in
+// from whoever has it, adds the outcome to the session's log and answers
+// with the log row.
+func (app *application) circulationItemPost(w http.ResponseWriter, r *http.Request) {
+	var form circulationItemForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	entry := pages.CirculationEntry{Time: time.Now(), Item: strings.TrimSpace(form.Item)}
+	switch form.Mode {
+	case "checkout":
+		err = app.circulationCheckOut(r, &entry)
+	case "checkin":
+		err = app.circulationCheckIn(r, &entry)
+	default:
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	log := append([]pages.CirculationEntry{entry}, app.circulationLog(r)...)
+	if len(log) > circulationLogSize {
+		log = log[:circulationLogSize]
+	}
+	app.sessionManager.Put(r.Context(), "circulationLog", log)
+	app.renderFragment(w, r, pages.CirculationRow(entry))
+}
+
+// circulationCheckOut issues the scanned copy, or a copy of the scanned
+// ISBN, to the current patron. Refusals are recorded on the entry; only
+// unexpected errors are returned.
+func (app *application) circulationCheckOut(r *http.Request, entry *pages.CirculationEntry) error {
+	entry.Action = "Check out"
+	patronID := app.sessionManager.GetInt(r.Context(), "circulationPatronID")
+	if patronID == 0 {
+		entry.Error = "Scan a patron card first"
+		return nil
+	}
+	patron, err := app.users.GetUserInfo(patronID)
+	if err != nil {
+		return err
+	}
+	entry.Patron = patron.Name
+	if entry.Item == "" {
+		entry.Error = "Nothing scanned"
+		return nil
+	}
+
+	c, err := app.copies.GetByBarcode(entry.Item)
+	if err == nil && c.Status == models.CopyOnLoan {
+		entry.Title = c.BookTitle
+		entry.Error = "Already on loan"
+		return nil
+	}
+
+	title, due, err := app.deskIssue(r, entry.Item, patronID)
+	entry.Title = title
+	switch {
+	case err == nil:
+		entry.Result = "Due " + due
+	case errors.Is(err, models.ErrNoRecord):
+		entry.Error = "No copy with this barcode and no book with this ISBN"
+	case blockMessage(err) != "":
+		entry.Error = blockMessage(err)
+	default:
+		return err
+	}
+	return nil
+}
+
+// circulationCheckIn returns the loan of the scanned copy as of now. A copy
+// in transit that isn't on loan is received at the working branch instead.
+func (app *application) circulationCheckIn(r *http.Request, entry *pages.CirculationEntry) error {
+	entry.Action = "Check in"
+	c, err := app.copies.GetByBarcode(entry.Item)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			entry.Error = "No copy with this barcode"
+			return nil
+		}
+		return err
+	}
+	entry.Title = c.BookTitle
+
+	branchID, err := app.workingBranch(r)
+	if err != nil {
+		return err
+	}
+	issue, err := app.issues.GetActiveByCopy(c.ID)
+	if errors.Is(err, models.ErrNoRecord) && c.Status == models.CopyInTransit {
+		entry.Action = "Receive"
+		entry.Result, entry.Error, err = app.receiveTransfer(r, c, branchID)
+		return err
+	}
+	if err == nil {
+		entry.Patron = issue.UserName
+		err = app.issues.CheckIn(issue.ID, app.getUserID(r), branchID, time.Now(), "")
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			entry.Error = "Not on loan"
+			return nil
+		}
+		return err
+	}
+
+	entry.Result = "Returned"
+	if issue.Overdue() {
+		entry.Result = "Returned late"
+	}
+	c, err = app.copies.Get(c.ID)
+	if err != nil {
+		return err
+	}
+	switch c.Status {
+	case models.CopyOnHold:
+		entry.Result += " - put it on the hold shelf"
+	case models.CopyInTransit:
+		entry.Result += " - send it to " + c.BranchName
+	}
+	return nil
+}
+
+func (app *application) circulationClearPost(w http.ResponseWriter, r *http.Request) {
+	app.sessionManager.Remove(r.Context(), "circulationPatronID")
+	app.sessionManager.Remove(r.Context(), "circulationLog")
+	http.Redirect(w, r, "/circulation", http.StatusSeeOther)
+}
+
+// --- kiosk ---
+
+type kioskEnrolForm struct {
+	Key                 string `form:"key"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) kioskEnrol(w http.ResponseWriter, r *http.Request) {
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.KioskEnrolPage(pages.KioskEnrolParams{CSRFToken: csrfToken}, flash)
+	})
+}
+
+// kioskEnrolPost turns this browser into a kiosk by storing the device key
+// an admin generated for it in a long-lived cookie.
+func (app *application) kioskEnrolPost(w http.ResponseWriter, r *http.Request) {
+	var form kioskEnrolForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Key = strings.TrimSpace(form.Key)
+	form.CheckField(validator.NotBlank(form.Key), "key", "Enter the device key")
+
+	if form.Valid() {
+		_, err = app.kiosks.Authenticate(form.Key)
+		switch {
+		case err == nil:
+			http.SetCookie(w, &http.Cookie{
+				Name:     kioskCookie,
+				Value:    form.Key,
+				Path:     "/kiosk",
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				Secure:   true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrInvalidCredentials):
+			form.AddFieldError("key", "This key isn't valid or has been revoked")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.KioskEnrolPage(pages.KioskEnrolParams{FieldErrors: form.FieldErrors, CSRFToken: csrfToken}, flash)
+	})
+}
+
+func (app *application) kiosk(w http.ResponseWriter, r *http.Request) {
+	app.renderKiosk(w, r, pages.KioskParams{})
+}
+
+type kioskLoginForm struct {
+	CardNumber          string `form:"card_number"`
+	PIN                 string `form:"pin"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) kioskLoginPost(w http.ResponseWriter, r *http.Request) {
+	var form kioskLoginForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CardNumber = strings.TrimSpace(form.CardNumber)
+
+	id, err := app.users.AuthenticatePIN(form.CardNumber, form.PIN)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			app.infoLog.Printf("kiosk %d: failed sign-in", app.getKiosk(r).ID)
+			app.renderKiosk(w, r, pages.KioskParams{Error: "Card number or PIN is incorrect."})
+		case errors.Is(err, models.ErrPINLocked):
+			app.infoLog.Printf("kiosk %d: sign-in refused for a locked card", app.getKiosk(r).ID)
+			app.renderKiosk(w, r, pages.KioskParams{Error: "Too many wrong PINs for this card. Try again later or ask at the desk."})
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "kioskPatronID", id)
+	app.sessionManager.Put(r.Context(), "kioskLastActive", time.Now().Unix())
+	http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+}
+
+func (app *application) kioskLogoutPost(w http.ResponseWriter, r *http.Request) {
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "kioskPatronID")
+	app.sessionManager.Put(r.Context(), "flash", "You're signed out. Thanks for visiting!")
+	http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+}
+
+type kioskScanForm struct {
+	Barcode string `form:"barcode"`
+}
+
+// kioskScanPost returns the scanned copy if the patron has it on loan, and
+// otherwise checks it out to them.
+func (app *application) kioskScanPost(w http.ResponseWriter, r *http.Request) {
+	patronID := app.sessionManager.GetInt(r.Context(), "kioskPatronID")
+	if patronID == 0 {
+		http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+		return
+	}
+
+	var form kioskScanForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	c, err := app.copies.GetByBarcode(strings.TrimSpace(form.Barcode))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.renderKiosk(w, r, pages.KioskParams{Error: "We don't recognise that barcode. Please ask at the desk."})
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	issue, err := app.issues.GetActiveByCopy(c.ID)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, err)
+		return
+	}
+	if err == nil && issue.UserID == patronID {
+		app.kioskReturn(w, r, issue.ID, c.BookTitle)
+		return
+	}
+
+	issueID, _, err := app.issues.KioskIssueCopy(c.ID, patronID, app.getKiosk(r).ID)
+	var msg string
+	switch {
+	case err == nil:
+		due, err := app.loanDue(issueID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("You've borrowed %q. It's due back on %s.", c.BookTitle, due))
+		http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+		return
+	case errors.Is(err, models.ErrCopyUnavailable), errors.Is(err, models.ErrBookWithdrawn):
+		msg = "This copy can't be borrowed right now. Please ask at the desk."
+	case errors.Is(err, models.ErrNotLoanable):
+		msg = "This is a reference item, so it can't leave the library."
+	case errors.Is(err, models.ErrAlreadyIssued):
+		msg = "You already have a copy of this book."
+	case errors.Is(err, models.ErrBorrowingSuspended), errors.Is(err, models.ErrNoLoanPolicy):
+		msg = "You can't borrow books at the kiosk. Please ask at the desk."
+	case errors.Is(err, models.ErrMembershipExpired):
+		msg = "Your library membership has expired. Please renew it at the desk."
+	case errors.Is(err, models.ErrFinesOutstanding):
+		msg = "You have unpaid fines. Please settle them at the desk before borrowing more books."
+	case errors.Is(err, models.ErrLoanLimitReached):
+		msg = "You've reached the maximum number of books you can borrow at once."
+	default:
+		app.serverError(w, err)
+		return
+	}
+	app.renderKiosk(w, r, pages.KioskParams{Error: msg})
+}
+
+func (app *application) kioskReturnPost(w http.ResponseWriter, r *http.Request) {
+	patronID := app.sessionManager.GetInt(r.Context(), "kioskPatronID")
+	if patronID == 0 {
+		http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+		return
+	}
+	issueID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	issue, err := app.issues.Get(issueID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if issue.UserID != patronID {
+		app.notFound(w)
+		return
+	}
+	app.kioskReturn(w, r, issueID, issue.BookTitle)
+}
+
+func (app *application) kioskReturn(w http.ResponseWriter, r *http.Request, issueID int, title string) {
+	patronID := app.sessionManager.GetInt(r.Context(), "kioskPatronID")
+	err := app.issues.KioskReturn(issueID, patronID, app.getKiosk(r).ID)
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Thanks! %q has been returned.", title))
+	case errors.Is(err, models.ErrNoRecord):
+		app.sessionManager.Put(r.Context(), "flash", "That book has already been returned.")
+	default:
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/kiosk", http.StatusSeeOther)
+}
+
+// renderKiosk shows the sign-in screen, or the signed-in patron's loans
+// with the scan field.
+func (app *application) renderKiosk(w http.ResponseWriter, r *http.Request, props pages.KioskParams) {
+	props.Kiosk = app.getKiosk(r)
+	props.TimeoutSeconds = int(app.kioskTimeout.Seconds())
+	if patronID := app.sessionManager.GetInt(r.Context(), "kioskPatronID"); patronID != 0 {
+		var err error
+		props.Patron, err = app.users.GetUserInfo(patronID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		props.Issues, err = app.issues.GetActiveByUser(patronID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.KioskPage(props, flash)
+	})
+}
+
+// --- staff check-in ---
+
+func (app *application) checkinLookup(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var book *models.Book
+	var issues []*models.Issue
+	if query != "" {
+		// a scanned barcode identifies the loan, so go straight to it
+		c, err := app.copies.GetByBarcode(query)
+		if err == nil {
+			issue, err := app.issues.GetActiveByCopy(c.ID)
+			if err == nil {
+				http.Redirect(w, r, fmt.Sprintf("/issues/%d/checkin", issue.ID), http.StatusSeeOther)
+				return
+			}
+			if !errors.Is(err, models.ErrNoRecord) {
+				app.serverError(w, err)
+				return
+			}
+		} else if !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+
+		book, err = app.books.GetByISBN(query)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		if book != nil {
+			issues, err = app.issues.GetActiveByBook(book.ID)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+	}
+	picker, err := app.branchPicker(r, "/checkin")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		picker.CSRFToken = csrfToken
+		return pages.CheckInLookupPage(query, book, issues, picker, flash, isAuthenticated)
+	})
+}
+
+type checkInForm struct {
+	ReturnedOn          string `form:"returned_on"`
+	ConditionNote       string `form:"condition_note"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) checkinForm(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderCheckIn(w, r, id, pages.CheckInFormParams{ReturnedOn: time.Now().Format("2006-01-02")})
+}
+
+func (app *application) checkinPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form checkInForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	returnedAt := time.Now()
+	if day, err := time.ParseInLocation("2006-01-02", form.ReturnedOn, time.Local); err != nil {
+		form.AddFieldError("returned_on", "Enter the date the book came back")
+	} else if endOfDay := day.AddDate(0, 0, 1).Add(-time.Second); endOfDay.Before(returnedAt) {
+		returnedAt = endOfDay
+	}
+	form.CheckField(validator.MaxChars(form.ConditionNote, 255), "condition_note", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		branchID, err := app.workingBranch(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = app.issues.CheckIn(id, app.getUserID(r), branchID, returnedAt, strings.TrimSpace(form.ConditionNote))
+		switch {
+		case err == nil:
+			flash, err := app.checkedInFlash(id)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.sessionManager.Put(r.Context(), "flash", flash)
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.sessionManager.Put(r.Context(), "flash", "That loan has already been returned.")
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrInvalidReturnTime):
+			form.AddFieldError("returned_on", "The return date must be between the issue date and today")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderCheckIn(w, r, id, pages.CheckInFormParams{
+		ReturnedOn:    form.ReturnedOn,
+		ConditionNote: form.ConditionNote,
+		FieldErrors:   form.FieldErrors,
+	})
+}
+
+// checkedInFlash confirms a check-in, telling staff to send the copy home
+// if it was returned at another branch.
+func (app *application) checkedInFlash(issueID int) (string, error) {
+	issue, err := app.issues.Get(issueID)
+	if err != nil {
+		return "", err
+	}
+	if issue.Barcode == "" {
+		return "Book checked in.", nil
+	}
+	c, err := app.copies.GetByBarcode(issue.Barcode)
+	if err != nil {
+		return "", err
+	}
+	if c.Status == models.CopyInTransit {
+		return "Book checked in. Copy " + c.Barcode + " belongs to " + c.BranchName + "; send it there.", nil
+	}
+	return "Book checked in.", nil
+}
+
+type lossForm struct {
+	Loss                string `form:"loss"`
+	Note                string `form:"loss_note"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) declareLossPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	ok, err := app.managesLoan(r, id)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+		return
+	case err != nil:
+		app.serverError(w, err)
+		return
+	case !ok:
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	var form lossForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.CheckField(validator.PermittedValue(form.Loss, models.LossLost, models.LossDamaged), "loss", "Choose lost or damaged")
+	form.CheckField(validator.MaxChars(form.Note, 255), "loss_note", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		charge, err := app.issues.DeclareLoss(id, app.getUserID(r), form.Loss, strings.TrimSpace(form.Note))
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Copy marked %s. Replacement charge: %s.", form.Loss, pages.Money(charge)))
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.sessionManager.Put(r.Context(), "flash", "That loan has already been returned.")
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderCheckIn(w, r, id, pages.CheckInFormParams{
+		ReturnedOn:  time.Now().Format("2006-01-02"),
+		Loss:        form.Loss,
+		LossNote:    form.Note,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+func (app *application) reverseLossPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	ok, err := app.managesLoan(r, id)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+		return
+	case err != nil:
+		app.serverError(w, err)
+		return
+	case !ok:
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.issues.ReverseLoss(id, app.getUserID(r))
+	switch {
+	case err == nil:
+		app.sessionManager.Put(r.Context(), "flash", "Copy back in circulation and replacement charge reversed.")
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+		return
+	case errors.Is(err, models.ErrNotLost):
+		app.sessionManager.Put(r.Context(), "flash", "That copy isn't marked lost any more.")
+	default:
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/issues", http.StatusSeeOther)
+}
+
+type recallForm struct {
+	RequestedBy         string `form:"requested_by"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) recallPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	ok, err := app.managesLoan(r, id)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+		return
+	case err != nil:
+		app.serverError(w, err)
+		return
+	case !ok:
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	var form recallForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.RequestedBy = strings.TrimSpace(form.RequestedBy)
+	form.CheckField(validator.NotBlank(form.RequestedBy), "requested_by", "Say who needs the book")
+	form.CheckField(validator.MaxChars(form.RequestedBy, 255), "requested_by", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		dueDate, err := app.issues.Recall(id, app.getUserID(r), form.RequestedBy)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Book recalled. The borrower has been notified; it's now due "+dueDate.Format("02 Jan 2006")+".")
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.sessionManager.Put(r.Context(), "flash", "That loan has already been returned.")
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrAlreadyRecalled):
+			app.sessionManager.Put(r.Context(), "flash", "That loan has already been recalled.")
+			http.Redirect(w, r, "/issues", http.StatusSeeOther)
+			return
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderCheckIn(w, r, id, pages.CheckInFormParams{
+		ReturnedOn:        time.Now().Format("2006-01-02"),
+		RecallRequestedBy: form.RequestedBy,
+		FieldErrors:       form.FieldErrors,
+	})
+}
+
+func (app *application) renderCheckIn(w http.ResponseWriter, r *http.Request, id int, props pages.CheckInFormParams) {
+	issue, err := app.issues.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	props.Issue = issue
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.CheckInPage(props, flash, isAuthenticated)
+	})
+}
+
+// --- transfers ---
+
+// transitReportDays is how long a copy may be in transit before the transit
+// report lists it by default.
+const transitReportDays = 3
+
+// allTransfers lists copies on their way between branches. Librarians see the
+// transfers from or to the branches they manage.
+func (app *application) allTransfers(w http.ResponseWriter, r *http.Request) {
+	days := transitReportDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	var scope []int
+	if !app.isAdmin(r) {
+		branches, err := app.staffBranches(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		scope = branchIDs(branches)
+	}
+	transfers, err := app.transfers.InTransit(days, scope)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	picker, err := app.branchPicker(r, "/transfers")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		picker.CSRFToken = csrfToken
+		return pages.TransfersPage(transfers, days, picker, flash, isAuthenticated)
+	})
+}
+
+type receiveForm struct {
+	Barcode string `form:"barcode"`
+}
+
+// transferReceivePost records that a scanned copy has arrived at the working
+// branch.
+func (app *application) transferReceivePost(w http.ResponseWriter, r *http.Request) {
+	var form receiveForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	c, err := app.copies.GetByBarcode(strings.TrimSpace(form.Barcode))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("No copy with barcode %q.", form.Barcode))
+			http.Redirect(w, r, "/transfers", http.StatusSeeOther)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+	branchID, err := app.workingBranch(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	result, refusal, err := app.receiveTransfer(r, c, branchID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if refusal != "" {
+		app.sessionManager.Put(r.Context(), "flash", "Copy "+c.Barcode+": "+refusal+".")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Copy "+c.Barcode+" ("+c.BookTitle+"): "+result+".")
+	}
+	http.Redirect(w, r, "/transfers", http.StatusSeeOther)
+}
+
+// receiveTransfer receives a copy in transit at branchID. It returns what to
+// do with the copy next, or why it couldn't be received; only unexpected
+// errors are returned.
+func (app *application) receiveTransfer(r *http.Request, c *models.Copy, branchID int) (string, string, error) {
+	status, err := app.transfers.Receive(c.ID, app.getUserID(r), branchID)
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrNotInTransit):
+		return "", "Not in transit", nil
+	case errors.Is(err, models.ErrWrongBranch):
+		return "", "Belongs to " + c.BranchName + "; send it there", nil
+	default:
+		return "", "", err
+	}
+	if status == models.CopyOnHold {
+		return "Received - put it on the hold shelf", "", nil
+	}
+	return "Received - back on the shelf", "", nil
+}
+
+// --- notices ---
+
+func (app *application) overdueNotices(w http.ResponseWriter, r *http.Request) {
+	runs, err := app.overdue.Runs(20)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	notices, err := app.overdue.Notices(100)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.NoticesPage(runs, notices, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) myNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := app.getUserID(r)
+	notifications, err := app.notifications.GetByUser(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	// the page shows what was unread before this visit
+	err = app.notifications.MarkAllRead(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.NotificationsPage(notifications, flash, isAuthenticated, csrfToken)
+	})
+}
+
+// --- holds ---
+
+func (app *application) placeHoldPost(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	_, err = app.holds.Place(bookID, app.getUserID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrCopiesAvailable):
+			app.sessionManager.Put(r.Context(), "flash", "A copy is available now - you can issue it directly.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBookWithdrawn):
+			app.sessionManager.Put(r.Context(), "flash", "That book has been withdrawn from the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrNotLoanable):
+			app.sessionManager.Put(r.Context(), "flash", "That book is for reference only and can't be borrowed. You can read it in the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrAlreadyIssued):
+			app.sessionManager.Put(r.Context(), "flash", "You already have this book issued.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrAlreadyOnHold):
+			app.sessionManager.Put(r.Context(), "flash", "You already have a hold on this book.")
+			http.Redirect(w, r, "/my-holds", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBorrowingSuspended):
+			app.sessionManager.Put(r.Context(), "flash", "Your borrowing is suspended, so you can't place holds. Check your notices or ask at the library desk.")
+			http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+		case errors.Is(err, models.ErrMembershipExpired):
+			app.sessionManager.Put(r.Context(), "flash", "Your library membership has expired. Please renew it at the library desk before placing holds.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Hold placed. We'll keep a copy for you when one comes back.")
+	http.Redirect(w, r, "/my-holds", http.StatusSeeOther)
+}
+
+func (app *application) myHolds(w http.ResponseWriter, r *http.Request) {
+	holds, err := app.holds.GetByUser(app.getUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.MyHoldsPage(holds, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) myHoldCancelPost(w http.ResponseWriter, r *http.Request) {
+	holdID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.holds.Cancel(holdID, app.getUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusForbidden)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Hold cancelled.")
+	http.Redirect(w, r, "/my-holds", http.StatusSeeOther)
+}
+
+func (app *application) allHolds(w http.ResponseWriter, r *http.Request) {
+	holds, err := app.holds.GetActive()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.AllHoldsPage(holds, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) holdCancelPost(w http.ResponseWriter, r *http.Request) {
+	holdID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.holds.CancelByStaff(holdID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Hold cancelled.")
+	http.Redirect(w, r, "/holds", http.StatusSeeOther)
+}
+
+// --- subscriptions ---
+
+func (app *application) subscribePost(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	_, err = app.subscriptions.Subscribe(bookID, app.getUserID(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+		case errors.Is(err, models.ErrCopiesAvailable):
+			app.sessionManager.Put(r.Context(), "flash", "A copy is available now - you can issue it directly.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrBookWithdrawn):
+			app.sessionManager.Put(r.Context(), "flash", "That book has been withdrawn from the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrNotLoanable):
+			app.sessionManager.Put(r.Context(), "flash", "That book is for reference only and can't be borrowed. You can read it in the library.")
+			http.Redirect(w, r, "/books", http.StatusSeeOther)
+		case errors.Is(err, models.ErrAlreadySubscribed):
+			app.sessionManager.Put(r.Context(), "flash", "You'll already be told when this book is back.")
+			http.Redirect(w, r, "/my-subscriptions", http.StatusSeeOther)
+		default:
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Done. We'll let you know in your notices when a copy is back on the shelf.")
+	http.Redirect(w, r, "/my-subscriptions", http.StatusSeeOther)
+}
+
+func (app *application) mySubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := app.subscriptions.GetByUser(app.getUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.MySubscriptionsPage(subscriptions, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) mySubscriptionCancelPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.subscriptions.Cancel(id, app.getUserID(r))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusForbidden)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Subscription cancelled.")
+	http.Redirect(w, r, "/my-subscriptions", http.StatusSeeOther)
+}
+
+// --- acquisitions ---
+
+type suggestionForm struct {
+	Title               string `form:"title"`
+	Author              string `form:"author"`
+	ISBN                string `form:"isbn"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) mySuggestions(w http.ResponseWriter, r *http.Request) {
+	app.renderSuggestions(w, r, pages.SuggestionsParams{})
+}
+
+func (app *application) suggestionPost(w http.ResponseWriter, r *http.Request) {
+	var form suggestionForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Title = strings.TrimSpace(form.Title)
+	form.Author = strings.TrimSpace(form.Author)
+	form.ISBN = strings.TrimSpace(form.ISBN)
+	form.CheckField(validator.NotBlank(form.Title), "title", "Title cannot be blank")
+	form.CheckField(validator.MaxChars(form.Title, 255), "title", "This field cannot be more than 255 characters long")
+	form.CheckField(validator.NotBlank(form.Author), "author", "Author cannot be blank")
+	form.CheckField(validator.MaxChars(form.Author, 255), "author", "This field cannot be more than 255 characters long")
+	form.CheckField(validator.MaxChars(form.ISBN, 20), "isbn", "This field cannot be more than 20 characters long")
+
+	if !form.Valid() {
+		app.renderSuggestions(w, r, pages.SuggestionsParams{
+			Title:       form.Title,
+			Author:      form.Author,
+			ISBN:        form.ISBN,
+			FieldErrors: form.FieldErrors,
+		})
+		return
+	}
+
+	_, err = app.suggestions.Insert(app.getUserID(r), form.Title, form.Author, form.ISBN)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Thanks! Librarians will review your suggestion, and you'll get a notice if it's added or turned down.")
+	http.Redirect(w, r, "/suggestions", http.StatusSeeOther)
+}
+
+func (app *application) renderSuggestions(w http.ResponseWriter, r *http.Request, props pages.SuggestionsParams) {
+	var err error
+	props.Suggestions, err = app.suggestions.GetByUser(app.getUserID(r))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.SuggestionsPage(props, flash, isAuthenticated)
+	})
+}
+
+// suggestionStatuses are the statuses the acquisitions list can be filtered
+// by; no filter shows every open suggestion.
+var suggestionStatuses = []string{
+	models.SuggestionPending,
+	models.SuggestionApproved,
+	models.SuggestionOrdered,
+	models.SuggestionReceived,
+	models.SuggestionRejected,
+}
+
+func (app *application) acquisitions(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if !slices.Contains(suggestionStatuses, status) {
+		status = ""
+	}
+	suggestions, err := app.suggestions.List(status)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.AcquisitionsPage(suggestions, status, suggestionStatuses, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) acquisitionView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderAcquisition(w, r, id, pages.AcquisitionParams{})
+}
+
+func (app *application) acquisitionApprovePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.suggestions.Approve(id, app.getUserID(r))
+	if err != nil {
+		app.suggestionStageError(w, r, id, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Suggestion approved.")
+	http.Redirect(w, r, "/acquisitions", http.StatusSeeOther)
+}
+
+type rejectSuggestionForm struct {
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) acquisitionRejectPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form rejectSuggestionForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Reason = strings.TrimSpace(form.Reason)
+	form.CheckField(validator.NotBlank(form.Reason), "reason", "Tell the patron why")
+	form.CheckField(validator.MaxChars(form.Reason, 255), "reason", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		err = app.suggestions.Reject(id, app.getUserID(r), form.Reason)
+		if err != nil {
+			app.suggestionStageError(w, r, id, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Suggestion rejected. The patron has been told why.")
+		http.Redirect(w, r, "/acquisitions", http.StatusSeeOther)
+		return
+	}
+
+	app.renderAcquisition(w, r, id, pages.AcquisitionParams{
+		Reason:      form.Reason,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type orderForm struct {
+	Vendor              string `form:"vendor"`
+	Cost                string `form:"cost"`
+	ExpectedOn          string `form:"expected_on"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) acquisitionOrderPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form orderForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Vendor = strings.TrimSpace(form.Vendor)
+	form.CheckField(validator.NotBlank(form.Vendor), "vendor", "Vendor cannot be blank")
+	form.CheckField(validator.MaxChars(form.Vendor, 255), "vendor", "This field cannot be more than 255 characters long")
+	cost, err := parseCents(form.Cost)
+	if err != nil || cost < 0 {
+		form.AddFieldError("cost", "Enter the order's cost, e.g. 24.99")
+	}
+	expectedOn, err := time.Parse("2006-01-02", form.ExpectedOn)
+	if err != nil {
+		form.AddFieldError("expected_on", "Enter the date the order is expected")
+	}
+
+	if form.Valid() {
+		err = app.suggestions.Order(id, app.getUserID(r), form.Vendor, cost, expectedOn)
+		if err != nil {
+			app.suggestionStageError(w, r, id, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Order recorded.")
+		http.Redirect(w, r, fmt.Sprintf("/acquisitions/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	app.renderAcquisition(w, r, id, pages.AcquisitionParams{
+		Vendor:      form.Vendor,
+		Cost:        form.Cost,
+		ExpectedOn:  form.ExpectedOn,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+type receiveOrderForm struct {
+	ISBN                string `form:"isbn"`
+	Copies              string `form:"copies"`
+	BranchID            int    `form:"branch_id"`
+	ItemTypeID          int    `form:"item_type_id"`
+	validator.Validator `form:"-"`
+}
+
+// acquisitionReceivePost adds an ordered book to the catalogue, with the
+// order's cost split across its copies as their replacement cost, and closes
+// the order.
+func (app *application) acquisitionReceivePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form receiveOrderForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	suggestion, err := app.suggestions.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if suggestion.Status != models.SuggestionOrdered {
+		app.suggestionStageError(w, r, id, models.ErrSuggestionStage)
+		return
+	}
+
+	form.ISBN = strings.TrimSpace(form.ISBN)
+	form.CheckField(validator.NotBlank(form.ISBN), "isbn", "ISBN cannot be blank")
+	form.CheckField(validator.MaxChars(form.ISBN, 20), "isbn", "This field cannot be more than 20 characters long")
+	copies, err := strconv.Atoi(form.Copies)
+	if err != nil || copies < 1 {
+		form.AddFieldError("copies", "Must be a number >= 1")
+	}
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	form.CheckField(hasBranch(branches, form.BranchID), "branch_id", "Choose a branch you manage")
+	itemTypes, err := app.itemTypes.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	form.CheckField(hasItemType(itemTypes, form.ItemTypeID), "item_type_id", "Choose an item type")
+
+	if form.Valid() {
+		bookID, err := app.suggestions.Receive(id, app.getUserID(r), form.ISBN, copies, form.BranchID, form.ItemTypeID)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%q is in the catalogue. %s has been told.", suggestion.Title, suggestion.UserName))
+			http.Redirect(w, r, fmt.Sprintf("/books/%d/copies", bookID), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrDuplicateISBN):
+			form.AddFieldError("isbn", "A book with this ISBN is already in the catalogue; add copies to it instead")
+		case errors.Is(err, models.ErrNoRecord), errors.Is(err, models.ErrSuggestionStage):
+			app.suggestionStageError(w, r, id, err)
+			return
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderAcquisition(w, r, id, pages.AcquisitionParams{
+		ISBN:        form.ISBN,
+		Copies:      form.Copies,
+		BranchID:    form.BranchID,
+		ItemTypeID:  form.ItemTypeID,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+// suggestionStageError answers a failed triage action: a 404 for an unknown
+// suggestion, or a flash if it has already moved past the stage the action
+// needs.
+func (app *application) suggestionStageError(w http.ResponseWriter, r *http.Request, id int, err error) {
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.notFound(w)
+	case errors.Is(err, models.ErrSuggestionStage):
+		app.sessionManager.Put(r.Context(), "flash", "That suggestion has already moved on. Check its current status.")
+		http.Redirect(w, r, fmt.Sprintf("/acquisitions/%d", id), http.StatusSeeOther)
+	default:
+		app.serverError(w, err)
+	}
+}
+
+func (app *application) renderAcquisition(w http.ResponseWriter, r *http.Request, id int, props pages.AcquisitionParams) {
+	var err error
+	props.Suggestion, err = app.suggestions.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	props.Branches, err = app.staffBranches(r)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if props.BranchID == 0 {
+		props.BranchID, err = app.workingBranch(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+	props.ItemTypes, err = app.itemTypes.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if props.ItemTypeID == 0 {
+		props.ItemTypeID = models.DefaultItemTypeID
+	}
+	if props.ISBN == "" {
+		props.ISBN = props.Suggestion.ISBN
+	}
+	if props.Copies == "" {
+		props.Copies = "1"
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.AcquisitionPage(props, flash, isAuthenticated)
+	})
+}
+
+func (app *application) acquisitionBudget(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil || year < 1 {
+		year = time.Now().Year()
+	}
+	app.renderBudget(w, r, year, pages.BudgetParams{})
+}
+
+type budgetForm struct {
+	Year                int    `form:"year"`
+	Amount              string `form:"amount"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) acquisitionBudgetPost(w http.ResponseWriter, r *http.Request) {
+	var form budgetForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if form.Year < 1 {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	amount, err := parseCents(form.Amount)
+	if err != nil || amount < 0 {
+		form.AddFieldError("amount", "Enter the year's budget, e.g. 5000.00")
+	}
+
+	if form.Valid() {
+		err = app.suggestions.SetBudget(form.Year, amount)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Budget for %d set to %s.", form.Year, pages.Money(amount)))
+		http.Redirect(w, r, fmt.Sprintf("/acquisitions/budget?year=%d", form.Year), http.StatusSeeOther)
+		return
+	}
+
+	app.renderBudget(w, r, form.Year, pages.BudgetParams{
+		Amount:      form.Amount,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+func (app *application) renderBudget(w http.ResponseWriter, r *http.Request, year int, props pages.BudgetParams) {
+	var err error
+	props.Report, err = app.suggestions.Budget(year)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.IsAdmin = app.isAdmin(r)
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.BudgetPage(props, flash, isAuthenticated)
+	})
+}
+
+// --- fines ---
+
+func (app *application) allFines(w http.ResponseWriter, r *http.Request) {
+	fines, err := app.fines.GetOutstanding()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.AllFinesPage(fines, flash, isAuthenticated, csrfToken)
+	})
+}
+
+type fineEntryForm struct {
+	Kind                string `form:"kind"`
+	Amount              string `form:"amount"`
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) fineView(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	app.renderFine(w, r, id, pages.FineEntryFormParams{Kind: models.EntryPayment})
+}
+
+func (app *application) fineEntryPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form fineEntryForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.PermittedValue(form.Kind, models.EntryPayment, models.EntryWaiver), "kind", "Choose payment or waiver")
+	amount, err := parseCents(form.Amount)
+	if err != nil || amount < 1 {
+		form.AddFieldError("amount", "Enter an amount greater than zero, e.g. 2.50")
+	}
+	if form.Kind == models.EntryWaiver {
+		form.CheckField(validator.NotBlank(form.Reason), "reason", "A waiver needs a reason")
+	}
+	form.CheckField(validator.MaxChars(form.Reason, 255), "reason", "This field cannot be more than 255 characters long")
+
+	if form.Valid() {
+		staffID := app.getUserID(r)
+		if form.Kind == models.EntryWaiver {
+			err = app.fines.Waive(id, staffID, amount, form.Reason)
+		} else {
+			err = app.fines.Pay(id, staffID, amount, form.Reason)
+		}
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Recorded "+form.Kind+" of "+pages.Money(amount)+".")
+			http.Redirect(w, r, fmt.Sprintf("/fines/%d", id), http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrNoRecord):
+			app.notFound(w)
+			return
+		case errors.Is(err, models.ErrExceedsBalance):
+			form.AddFieldError("amount", "Amount is more than what's owed")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderFine(w, r, id, pages.FineEntryFormParams{
+		Kind:        form.Kind,
+		Amount:      form.Amount,
+		Reason:      form.Reason,
+		FieldErrors: form.FieldErrors,
+	})
+}
+
+func (app *application) renderFine(w http.ResponseWriter, r *http.Request, id int, props pages.FineEntryFormParams) {
+	fine, err := app.fines.Get(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	ledger, err := app.fines.Ledger(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.FinePage(fine, ledger, props, flash, isAuthenticated)
+	})
+}
+
+// --- admin ---
+
+func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.users.ListUsers()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.AdminUsersPage(users, flash, isAuthenticated, csrfToken)
+	})
+}
+
+func (app *application) adminPromotePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	err = app.users.PromoteToLibrarian(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "User promoted to librarian.")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+type loanPolicyForm struct {
+	LoanDays            string `form:"loan_days"`
+	MaxLoans            string `form:"max_loans"`
+	MaxRenewals         string `form:"max_renewals"`
+	GraceDays           string `form:"grace_days"`
+	RecallMinDays       string `form:"recall_min_days"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) adminLoanPolicies(w http.ResponseWriter, r *http.Request) {
+	app.renderLoanPolicies(w, r, nil)
+}
+
+func (app *application) adminLoanPolicyPost(w http.ResponseWriter, r *http.Request) {
+	role := chi.URLParam(r, "role")
+
+	var form loanPolicyForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	policy := &models.LoanPolicy{Role: role}
+	policy.LoanDays, err = strconv.Atoi(form.LoanDays)
+	form.CheckField(err == nil && policy.LoanDays >= 1, "loan_days", "Must be a number >= 1")
+	policy.MaxLoans, err = strconv.Atoi(form.MaxLoans)
+	form.CheckField(err == nil && policy.MaxLoans >= 0, "max_loans", "Must be a number >= 0")
+	policy.MaxRenewals, err = strconv.Atoi(form.MaxRenewals)
+	form.CheckField(err == nil && policy.MaxRenewals >= 0, "max_renewals", "Must be a number >= 0")
+	policy.GraceDays, err = strconv.Atoi(form.GraceDays)
+	form.CheckField(err == nil && policy.GraceDays >= 0, "grace_days", "Must be a number >= 0")
+	policy.RecallMinDays, err = strconv.Atoi(form.RecallMinDays)
+	form.CheckField(err == nil && policy.RecallMinDays >= 0, "recall_min_days", "Must be a number >= 0")
+
+	if !form.Valid() {
+		app.renderLoanPolicies(w, r, &pages.LoanPolicyRow{
+			Role:          role,
+			LoanDays:      form.LoanDays,
+			MaxLoans:      form.MaxLoans,
+			MaxRenewals:   form.MaxRenewals,
+			GraceDays:     form.GraceDays,
+			RecallMinDays: form.RecallMinDays,
+			FieldErrors:   form.FieldErrors,
+		})
+		return
+	}
+
+	err = app.loanPolicies.Update(policy)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Loan policy for "+role+" updated.")
+	http.Redirect(w, r, "/admin/loan-policies", http.StatusSeeOther)
+}
+
+// renderLoanPolicies shows every policy as an editable row. invalid, if set,
+// replaces its role's row so the admin sees what they typed and why it failed.
+func (app *application) renderLoanPolicies(w http.ResponseWriter, r *http.Request, invalid *pages.LoanPolicyRow) {
+	policies, err := app.loanPolicies.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var rows []pages.LoanPolicyRow
+	for _, p := range policies {
+		if invalid != nil && invalid.Role == p.Role {
+			rows = append(rows, *invalid)
+			continue
+		}
+		rows = append(rows, pages.LoanPolicyRow{
+			Role:          p.Role,
+			LoanDays:      strconv.Itoa(p.LoanDays),
+			MaxLoans:      strconv.Itoa(p.MaxLoans),
+			MaxRenewals:   strconv.Itoa(p.MaxRenewals),
+			GraceDays:     strconv.Itoa(p.GraceDays),
+			RecallMinDays: strconv.Itoa(p.RecallMinDays),
+		})
+	}
+
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		return pages.LoanPoliciesPage(rows, flash, isAuthenticated, csrfToken)
+	})
+}
+
+type itemTypeRuleForm struct {
+	Name                string `form:"name"`
+	Loanable            bool   `form:"loanable"`
+	LoanDays            string `form:"loan_days"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) adminItemTypes(w http.ResponseWriter, r *http.Request) {
+	app.renderItemTypes(w, r, pages.ItemTypesParams{Loanable: true}, nil)
+}
+
+func (app *application) adminItemTypePost(w http.ResponseWriter, r *http.Request) {
+	var form itemTypeRuleForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Name, 50), "name", "This field cannot be more than 50 characters long")
+	// blank keeps the loan policy's period, stored as 0
+	loanDays := 0
+	if form.LoanDays = strings.TrimSpace(form.LoanDays); form.LoanDays != "" {
+		loanDays, err = strconv.Atoi(form.LoanDays)
+		form.CheckField(err == nil && loanDays >= 1, "loan_days", "Must be a number >= 1, or blank")
+	}
+
+	if form.Valid() {
+		_, err = app.itemTypes.Insert(form.Name, form.Loanable, loanDays)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Item type added.")
+			http.Redirect(w, r, "/admin/item-types", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrDuplicateItemType):
+			form.AddFieldError("name", "An item type with this name already exists")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	app.renderItemTypes(w, r, pages.ItemTypesParams{
+		Name:        form.Name,
+		Loanable:    form.Loanable,
+		LoanDays:    form.LoanDays,
+		FieldErrors: form.FieldErrors,
+	}, nil)
+}
+
+func (app *application) adminItemTypeUpdatePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	var form itemTypeRuleForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	itemType := &models.ItemType{ID: id, Loanable: form.Loanable}
+	if form.LoanDays = strings.TrimSpace(form.LoanDays); form.LoanDays != "" {
+		itemType.LoanDays, err = strconv.Atoi(form.LoanDays)
+		form.CheckField(err == nil && itemType.LoanDays >= 1, "loan_days", "Must be a number >= 1, or blank")
+	}
+
+	if !form.Valid() {
+		app.renderItemTypes(w, r, pages.ItemTypesParams{Loanable: true}, &pages.ItemTypeRow{
+			ID:          id,
+			Loanable:    form.Loanable,
+			LoanDays:    form.LoanDays,
+			FieldErrors: form.FieldErrors,
+		})
+		return
+	}
+
+	err = app.itemTypes.Update(itemType)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Item type updated.")
+	http.Redirect(w, r, "/admin/item-types", http.StatusSeeOther)
+}
+
+// renderItemTypes shows every item type as an editable row. invalid, if set,
+// replaces its type's row so the admin sees what they typed and why it failed.
+func (app *application) renderItemTypes(w http.ResponseWriter, r *http.Request, props pages.ItemTypesParams, invalid *pages.ItemTypeRow) {
+	itemTypes, err := app.itemTypes.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	for _, t := range itemTypes {
+		if invalid != nil && invalid.ID == t.ID {
+			invalid.Name = t.Name
+			props.Rows = append(props.Rows, *invalid)
+			continue
+		}
+		row := pages.ItemTypeRow{ID: t.ID, Name: t.Name, Loanable: t.Loanable}
+		if t.LoanDays > 0 {
+			row.LoanDays = strconv.Itoa(t.LoanDays)
+		}
+		props.Rows = append(props.Rows, row)
+	}
+
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.ItemTypesPage(props, flash, isAuthenticated)
+	})
+}
+
+type openingDaysForm struct {
+	Days []int `form:"days"`
+}
+
+type closureForm struct {
+	StartsOn            string `form:"starts_on"`
+	EndsOn              string `form:"ends_on"`
+	Reason              string `form:"reason"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) adminCalendar(w http.ResponseWriter, r *http.Request) {
+	app.renderCalendar(w, r, pages.CalendarParams{})
+}
+
+func (app *application) adminOpeningDaysPost(w http.ResponseWriter, r *http.Request) {
+	var form openingDaysForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	var days []time.Weekday
+	for _, d := range form.Days {
+		if d < int(time.Sunday) || d > int(time.Saturday) {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		days = append(days, time.Weekday(d))
+	}
+
+	err = app.calendar.SetOpeningDays(days)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Opening days updated.")
+	http.Redirect(w, r, "/admin/calendar", http.StatusSeeOther)
+}
+
+func (app *application) adminClosurePost(w http.ResponseWriter, r *http.Request) {
+	var form closureForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	startsOn, err := time.Parse("2006-01-02", form.StartsOn)
+	if err != nil {
+		form.AddFieldError("starts_on", "Enter the first day the library is closed")
+	}
+	endsOn, err := time.Parse("2006-01-02", form.EndsOn)
+	if err != nil {
+		form.AddFieldError("ends_on", "Enter the last day the library is closed")
+	} else if endsOn.Before(startsOn) {
+		form.AddFieldError("ends_on", "Must be on or after the first closed day")
+	}
+	form.Reason = strings.TrimSpace(form.Reason)
+	form.CheckField(validator.NotBlank(form.Reason), "reason", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Reason, 255), "reason", "This field cannot be more than 255 characters long")
+
+	if !form.Valid() {
+		app.renderCalendar(w, r, pages.CalendarParams{
+			StartsOn:    form.StartsOn,
+			EndsOn:      form.EndsOn,
+			Reason:      form.Reason,
+			FieldErrors: form.FieldErrors,
+		})
+		return
+	}
+
+	_, err = app.calendar.AddClosure(startsOn, endsOn, form.Reason)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Closure added.")
+	http.Redirect(w, r, "/admin/calendar", http.StatusSeeOther)
+}
+
+func (app *application) adminClosureDeletePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	err = app.calendar.DeleteClosure(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Closure removed.")
+	http.Redirect(w, r, "/admin/calendar", http.StatusSeeOther)
+}
+
+func (app *application) renderCalendar(w http.ResponseWriter, r *http.Request, props pages.CalendarParams) {
+	days, err := app.calendar.OpeningDays()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	closures, err := app.calendar.Closures()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.OpeningDays = days
+	props.Closures = closures
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.CalendarPage(props, flash, isAuthenticated)
+	})
+}
+
+type branchForm struct {
+	Name                string `form:"name"`
+	validator.Validator `form:"-"`
+}
+
+type staffBranchesForm struct {
+	BranchIDs []int `form:"branch_id"`
+}
+
+func (app *application) adminBranches(w http.ResponseWriter, r *http.Request) {
+	app.renderBranches(w, r, pages.BranchesParams{})
+}
+
+func (app *application) adminBranchPost(w http.ResponseWriter, r *http.Request) {
+	var form branchForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Name, 100), "name", "This field cannot be more than 100 characters long")
+
+	if form.Valid() {
+		_, err = app.branches.Insert(form.Name)
+		switch {
+		case err == nil:
+			app.sessionManager.Put(r.Context(), "flash", "Branch added.")
+			http.Redirect(w, r, "/admin/branches", http.StatusSeeOther)
+			return
+		case errors.Is(err, models.ErrDuplicateBranch):
+			form.AddFieldError("name", "There is already a branch with this name")
+		default:
+			app.serverError(w, err)
+			return
+		}
+	}
+	app.renderBranches(w, r, pages.BranchesParams{Name: form.Name, FieldErrors: form.FieldErrors})
+}
+
+// adminStaffBranchesPost sets the branches a librarian manages.
+func (app *application) adminStaffBranchesPost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	role, err := app.users.GetRole(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	if role != "librarian" {
+		app.notFound(w)
+		return
+	}
+
+	var form staffBranchesForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	branches, err := app.branches.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	for _, branchID := range form.BranchIDs {
+		if !hasBranch(branches, branchID) {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = app.branches.SetManaged(id, form.BranchIDs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Branches updated.")
+	http.Redirect(w, r, "/admin/branches", http.StatusSeeOther)
+}
+
+func (app *application) renderBranches(w http.ResponseWriter, r *http.Request, props pages.BranchesParams) {
+	var err error
+	props.Branches, err = app.branches.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Staff, err = app.branches.Staff()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.BranchesPage(props, flash, isAuthenticated)
+	})
+}
+
+type kioskForm struct {
+	Name                string `form:"name"`
+	BranchID            int    `form:"branch_id"`
+	validator.Validator `form:"-"`
+}
+
+func (app *application) adminKiosks(w http.ResponseWriter, r *http.Request) {
+	app.renderKiosks(w, r, pages.KiosksParams{})
+}
+
+func (app *application) adminKioskPost(w http.ResponseWriter, r *http.Request) {
+	var form kioskForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	form.Name = strings.TrimSpace(form.Name)
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Name, 100), "name", "This field cannot be more than 100 characters long")
+	_, err = app.branches.Get(form.BranchID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		form.AddFieldError("branch_id", "Choose a branch")
+	}
+
+	props := pages.KiosksParams{Name: form.Name, BranchID: form.BranchID, FieldErrors: form.FieldErrors}
+	if form.Valid() {
+		_, key, err := app.kiosks.Insert(form.Name, form.BranchID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		// the key is only shown this once
+		props = pages.KiosksParams{NewKiosk: form.Name, NewKey: key}
+	}
+	app.renderKiosks(w, r, props)
+}
+
+func (app *application) adminKioskRevokePost(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+	err = app.kiosks.Revoke(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Kiosk revoked. It can't be used until it's enrolled with a new key.")
+	http.Redirect(w, r, "/admin/kiosks", http.StatusSeeOther)
+}
+
+func (app *application) renderKiosks(w http.ResponseWriter, r *http.Request, props pages.KiosksParams) {
+	kiosks, err := app.kiosks.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	props.Kiosks = kiosks
+	props.Branches, err = app.branches.List()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.RenderPage(w, r, func(flash string, isAuthenticated bool, csrfToken string) templ.Component {
+		props.CSRFToken = csrfToken
+		return pages.KiosksPage(props, flash, isAuthenticated)
+	})
+}
+
+// -- librarian issue management --
+
+// allIssues lists every loan for admins, and for librarians the loans of
+// the branches they manage.
+func (app *application) allIssues(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	if !app.isAdmin(r) {
+		branches, err := app.staffBranches(r)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		ids = branchIDs(branches)
+	}
+	issues, err := app.issues.GetAll(ids)
 	if err != nil {
 		app.serverError(w, err)
 		return
@@ -3,12 +3,19 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/a-h/templ"
 	"github.com/go-playground/form"
 	"github.com/justinas/nosurf"
+	"github.com/kayden-vs/library/internal/models"
+	"github.com/kayden-vs/library/ui/html/pages"
 )
 
 func (app *application) serverError(w http.ResponseWriter, err error) {
@@ -44,6 +51,16 @@ func (app *application) RenderPage(
 	}
 }
 
+// renderFragment renders a component on its own, without the page layout,
+// for requests made from scripts.
+func (app *application) renderFragment(w http.ResponseWriter, r *http.Request, c templ.Component) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := c.Render(r.Context(), w)
+	if err != nil {
+		app.serverError(w, err)
+	}
+}
+
 func (app *application) decodePostForm(r *http.Request, dst any) error {
 	err := r.ParseForm()
 	if err != nil {
@@ -81,6 +98,13 @@ func (app *application) getUserRole(r *http.Request) string {
 	return role
 }
 
+// getKiosk returns the kiosk making the request; only set behind
+// requireKiosk.
+func (app *application) getKiosk(r *http.Request) *models.Kiosk {
+	kiosk, _ := r.Context().Value(kioskContextKey).(*models.Kiosk)
+	return kiosk
+}
+
 func (app *application) isLibrarian(r *http.Request) bool {
 	role := app.getUserRole(r)
 	return role == "librarian" || role == "admin"
@@ -89,3 +113,222 @@ func (app *application) isLibrarian(r *http.Request) bool {
 func (app *application) isAdmin(r *http.Request) bool {
 	return app.getUserRole(r) == "admin"
 }
+
+// staffBranches returns the branches the signed-in staff member can act
+// for: every branch for admins, the ones they manage for librarians.
+func (app *application) staffBranches(r *http.Request) ([]*models.Branch, error) {
+	if app.isAdmin(r) {
+		return app.branches.List()
+	}
+	return app.branches.ManagedBy(app.getUserID(r))
+}
+
+// workingBranch returns the ID of the branch the signed-in staff member is
+// working at: their chosen branch if they can act for it, otherwise the
+// first one they can. It returns 0 if they can't act for any.
+func (app *application) workingBranch(r *http.Request) (int, error) {
+	user, err := app.users.GetUserInfo(app.getUserID(r))
+	if err != nil {
+		return 0, err
+	}
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		return 0, err
+	}
+	if hasBranch(branches, user.DefaultBranchID) {
+		return user.DefaultBranchID, nil
+	}
+	if len(branches) == 0 {
+		return 0, nil
+	}
+	return branches[0].ID, nil
+}
+
+// branchPicker fills in the working branch switcher shown on the
+// circulation pages; next is the page to come back to.
+func (app *application) branchPicker(r *http.Request, next string) (pages.BranchPickerParams, error) {
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		return pages.BranchPickerParams{}, err
+	}
+	current, err := app.workingBranch(r)
+	if err != nil {
+		return pages.BranchPickerParams{}, err
+	}
+	return pages.BranchPickerParams{Branches: branches, Current: current, Next: next}, nil
+}
+
+// managesLoan reports whether the signed-in staff member manages the home
+// branch of the loan's copy. Loans from before per-copy tracking have no
+// copy and are left to admins. It fails with models.ErrNoRecord if there's
+// no such loan.
+func (app *application) managesLoan(r *http.Request, issueID int) (bool, error) {
+	issue, err := app.issues.Get(issueID)
+	if err != nil {
+		return false, err
+	}
+	if app.isAdmin(r) {
+		return true, nil
+	}
+	if issue.Barcode == "" {
+		return false, nil
+	}
+	c, err := app.copies.GetByBarcode(issue.Barcode)
+	if err != nil {
+		return false, err
+	}
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		return false, err
+	}
+	return hasBranch(branches, c.BranchID), nil
+}
+
+// managesBook reports whether every copy of the book belongs to a branch the
+// signed-in staff member manages.
+func (app *application) managesBook(r *http.Request, bookID int) (bool, error) {
+	if app.isAdmin(r) {
+		return true, nil
+	}
+	copies, err := app.copies.GetByBook(bookID)
+	if err != nil {
+		return false, err
+	}
+	branches, err := app.staffBranches(r)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range copies {
+		if !hasBranch(branches, c.BranchID) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isLocalPath reports whether s is a path on this site and so safe to
+// redirect to. Browsers treat "//host" and "/\host" as other sites.
+func isLocalPath(s string) bool {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+func hasBranch(branches []*models.Branch, id int) bool {
+	for _, b := range branches {
+		if b.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func hasItemType(itemTypes []*models.ItemType, id int) bool {
+	for _, t := range itemTypes {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func branchIDs(branches []*models.Branch) []int {
+	ids := make([]int, 0, len(branches))
+	for _, b := range branches {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+// loanDue describes when a loan is due back, for flash messages.
+func (app *application) loanDue(issueID int) (string, error) {
+	issue, err := app.issues.Get(issueID)
+	if err != nil {
+		return "", err
+	}
+	return pages.DueDate(issue), nil
+}
+
+// centsRX matches a money amount with at most two decimal places.
+var centsRX = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]{1,2}))?$`)
+
+// parseCents converts a money amount typed into a form ("2.50") into cents.
+// It is parsed as a decimal, not a float, so there's no rounding; anything
+// else, or an amount too large for the INTEGER money columns, is an error.
+func parseCents(s string) (int, error) {
+	m := centsRX.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	units, err := strconv.Atoi(m[1])
+	if err != nil || units > math.MaxInt32/100 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+	cents := 0
+	if m[2] != "" {
+		frac := m[2]
+		if len(frac) == 1 {
+			frac += "0"
+		}
+		cents, _ = strconv.Atoi(frac)
+	}
+	total := units*100 + cents
+	if total > math.MaxInt32 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+	return total, nil
+}
+
+// blockMessage describes, for staff, why a patron can't be issued a book.
+// It returns "" for errors that aren't circulation refusals.
+func blockMessage(err error) string {
+	switch {
+	case errors.Is(err, models.ErrNoCopiesAvailable):
+		return "No copies available right now"
+	case errors.Is(err, models.ErrCopyUnavailable):
+		return "This copy is not on the shelf"
+	case errors.Is(err, models.ErrBookWithdrawn):
+		return "This book has been withdrawn"
+	case errors.Is(err, models.ErrNotLoanable):
+		return "Reference only - it can't leave the library"
+	case errors.Is(err, models.ErrWrongBranch):
+		return "This copy, or the one held for the patron, is at another branch"
+	case errors.Is(err, models.ErrNoBranch):
+		return "You don't manage a branch to issue books from"
+	case errors.Is(err, models.ErrAlreadyIssued):
+		return "Patron already has this book issued"
+	case errors.Is(err, models.ErrBorrowingSuspended):
+		return "Borrowing suspended"
+	case errors.Is(err, models.ErrMembershipExpired):
+		return "Membership expired - renew it to borrow"
+	case errors.Is(err, models.ErrFinesOutstanding):
+		return "Unpaid fines over the borrowing limit"
+	case errors.Is(err, models.ErrLoanLimitReached):
+		return "At the maximum number of loans for their role"
+	default:
+		return ""
+	}
+}
+
+// renewalRefusal describes, for staff, why a loan can't be renewed. It
+// returns "" for errors that aren't renewal refusals.
+func renewalRefusal(err error) string {
+	switch {
+	case errors.Is(err, models.ErrRenewalLimitReached):
+		return "no renewals left on this loan"
+	case errors.Is(err, models.ErrRenewalOverdue):
+		return "too far overdue to renew"
+	case errors.Is(err, models.ErrHoldsPending):
+		return "another patron is waiting for this book"
+	case errors.Is(err, models.ErrRecalled):
+		return "the book has been recalled"
+	case errors.Is(err, models.ErrBorrowingSuspended):
+		return "borrowing suspended"
+	case errors.Is(err, models.ErrMembershipExpired):
+		return "membership expired"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kayden-vs/library/internal/models"
+)
+
+// expireHolds releases copies held for patrons who didn't pick them up in
+// time. It runs once at startup and then on every tick.
+func (app *application) expireHolds(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := app.holds.ExpireReady()
+		if err != nil {
+			app.errorLog.Printf("expiring holds: %v", err)
+		} else if n > 0 {
+			app.infoLog.Printf("expired %d uncollected holds", n)
+		}
+		<-ticker.C
+	}
+}
+
+// processOverdue sends overdue notices and applies the final notice action.
+// Each run is recorded in job_runs, so failures are also visible to
+// librarians on the notices page.
+func (app *application) processOverdue(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		run, err := app.overdue.Process()
+		if run != nil {
+			app.logFailures(run)
+		}
+		if err != nil {
+			app.errorLog.Printf("processing overdue loans: %v", err)
+		} else if run.Processed > 0 || run.Failed > 0 {
+			app.infoLog.Printf("sent %d overdue notices, %d failed", run.Processed, run.Failed)
+		}
+		<-ticker.C
+	}
+}
+
+// applyRetention anonymises loans returned longer ago than the retention
+// period. It runs once at startup and then on every tick.
+func (app *application) applyRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		run, err := app.retention.Process()
+		if err != nil {
+			app.errorLog.Printf("anonymising old loans: %v", err)
+		} else {
+			app.infoLog.Printf("anonymised %d old loans", run.Processed)
+		}
+		<-ticker.C
+	}
+}
+
+// runJob runs a background job once, for the -run-job flag, and logs what it
+// did.
+func (app *application) runJob(name string) error {
+	var run *models.JobRun
+	var err error
+	switch name {
+	case "overdue":
+		run, err = app.overdue.Process()
+	case "retention":
+		run, err = app.retention.Process()
+	default:
+		return fmt.Errorf("unknown job %q", name)
+	}
+	if run != nil {
+		app.logFailures(run)
+	}
+	if err != nil {
+		return err
+	}
+	app.infoLog.Printf("%s job: %d records changed, %d failed", run.Job, run.Processed, run.Failed)
+	return nil
+}
+
+// logFailures logs each record a job run had to skip.
+func (app *application) logFailures(run *models.JobRun) {
+	for _, err := range run.Failures {
+		app.errorLog.Printf("%s job run %d: %v", run.Job, run.ID, err)
+	}
+}
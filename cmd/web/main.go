@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/gob"
 	"flag"
 	"log"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"github.com/go-playground/form"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/kayden-vs/library/internal/models"
+	"github.com/kayden-vs/library/ui/html/pages"
 )
 
 type application struct {
@@ -20,7 +22,25 @@ type application struct {
 	infoLog        *log.Logger
 	users          models.UserModelInterface
 	books          models.BookModelInterface
+	copies         models.CopyModelInterface
 	issues         models.IssueModelInterface
+	holds          models.HoldModelInterface
+	fines          models.FineModelInterface
+	loanPolicies   models.LoanPolicyModelInterface
+	calendar       models.CalendarModelInterface
+	overdue        models.OverdueModelInterface
+	notifications  models.NotificationModelInterface
+	subscriptions  models.SubscriptionModelInterface
+	suggestions    models.SuggestionModelInterface
+	blocks         models.PatronBlockModelInterface
+	patronNotes    models.PatronNoteModelInterface
+	retention      models.RetentionModelInterface
+	kiosks         models.KioskModelInterface
+	branches       models.BranchModelInterface
+	transfers      models.TransferModelInterface
+	reserves       models.ReserveModelInterface
+	itemTypes      models.ItemTypeModelInterface
+	kioskTimeout   time.Duration
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
 }
@@ -28,12 +48,35 @@ type application struct {
 func main() {
 	addr := flag.String("addr", ":4000", "HTTP server port")
 	dsn := flag.String("dsn", "library_user:eren@tcp(localhost:3306)/library?parseTime=true", "MySQL data source name")
+	holdPickupDays := flag.Int("hold-pickup-days", 3, "Days a returned copy is kept for the next hold")
+	finePerDay := flag.Int("fine-per-day", 10, "Overdue fine per day, in cents")
+	fineCap := flag.Int("fine-cap", 1000, "Maximum overdue fine per loan, in cents (0 for no cap)")
+	fineBlock := flag.Int("fine-block-threshold", 500, "Outstanding fines above which borrowing is blocked, in cents")
+	overdueInterval := flag.Duration("overdue-interval", time.Hour, "How often to check for overdue loans")
+	noticeFirst := flag.Int("notice-first-days", 1, "Days overdue before the first notice (0 to skip)")
+	noticeSecond := flag.Int("notice-second-days", 7, "Days overdue before the second notice (0 to skip)")
+	noticeFinal := flag.Int("notice-final-days", 14, "Days overdue before the final notice (0 to skip)")
+	finalAction := flag.String("notice-final-action", models.FinalActionSuspend, "What the final notice does: none, suspend or lost")
+	retentionDays := flag.Int("retention-days", 0, "Days after return before a loan is anonymised (0 to keep loans linked forever)")
+	retentionInterval := flag.Duration("retention-interval", 24*time.Hour, "How often to anonymise old loans")
+	membershipMonths := flag.Int("membership-months", 12, "How long a membership lasts from sign-up or renewal, in months (0 for memberships that never expire)")
+	kioskTimeout := flag.Duration("kiosk-timeout", 2*time.Minute, "Inactivity after which a patron is signed out of a kiosk")
+	runJob := flag.String("run-job", "", "Run one job (overdue or retention) and exit instead of starting the server")
 
 	flag.Parse()
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	switch *finalAction {
+	case models.FinalActionNone, models.FinalActionSuspend, models.FinalActionLost:
+	default:
+		errorLog.Fatalf("invalid -notice-final-action %q", *finalAction)
+	}
+	if *runJob == "retention" && *retentionDays <= 0 {
+		errorLog.Fatal("-run-job retention needs -retention-days")
+	}
+
 	db, err := openDB(*dsn)
 	if err != nil {
 		errorLog.Fatal(err)
@@ -42,20 +85,74 @@ func main() {
 
 	formDecoder := form.NewDecoder()
 
+	// session values other than basic types must be registered with gob
+	gob.Register([]pages.CirculationEntry{})
+
 	sessionManager := scs.New()
 	sessionManager.Store = mysqlstore.New(db)
 	sessionManager.Lifetime = 12 * time.Hour
 
+	issues := &models.IssueModel{
+		DB:             db,
+		HoldPickupDays: *holdPickupDays,
+		Fines: models.FineRules{
+			PerDay:         *finePerDay,
+			Cap:            *fineCap,
+			BlockThreshold: *fineBlock,
+		},
+	}
+
 	app := &application{
-		errorLog:       errorLog,
-		infoLog:        infoLog,
-		users:          &models.UserModel{DB: db},
-		books:          &models.BookModel{DB: db},
-		issues:         &models.IssueModel{DB: db},
+		errorLog:     errorLog,
+		infoLog:      infoLog,
+		users:        &models.UserModel{DB: db, MembershipMonths: *membershipMonths},
+		books:        &models.BookModel{DB: db},
+		copies:       &models.CopyModel{DB: db, HoldPickupDays: *holdPickupDays},
+		issues:       issues,
+		holds:        &models.HoldModel{DB: db, PickupDays: *holdPickupDays},
+		fines:        &models.FineModel{DB: db},
+		loanPolicies: &models.LoanPolicyModel{DB: db},
+		calendar:     &models.CalendarModel{DB: db},
+		overdue: &models.OverdueModel{
+			DB: db,
+			Rules: models.NoticeRules{
+				FirstDays:   *noticeFirst,
+				SecondDays:  *noticeSecond,
+				FinalDays:   *noticeFinal,
+				FinalAction: *finalAction,
+			},
+			Issues: issues,
+		},
+		notifications:  &models.NotificationModel{DB: db},
+		subscriptions:  &models.SubscriptionModel{DB: db},
+		suggestions:    &models.SuggestionModel{DB: db},
+		blocks:         &models.PatronBlockModel{DB: db},
+		patronNotes:    &models.PatronNoteModel{DB: db},
+		retention:      &models.RetentionModel{DB: db, Days: *retentionDays},
+		kiosks:         &models.KioskModel{DB: db},
+		branches:       &models.BranchModel{DB: db},
+		transfers:      &models.TransferModel{DB: db, HoldPickupDays: *holdPickupDays},
+		reserves:       &models.ReserveModel{DB: db},
+		itemTypes:      &models.ItemTypeModel{DB: db},
+		kioskTimeout:   *kioskTimeout,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
 	}
 
+	if *runJob != "" {
+		err = app.runJob(*runJob)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		return
+	}
+
+	go app.expireHolds(time.Hour)
+	go app.processOverdue(*overdueInterval)
+	if *retentionDays > 0 {
+		go app.applyRetention(*retentionInterval)
+	}
+
 	srv := &http.Server{
 		Addr:         *addr,
 		ErrorLog:     errorLog,
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/justinas/nosurf"
+	"github.com/kayden-vs/library/internal/models"
 )
 
 func secureHeaders(next http.Handler) http.Handler {
@@ -96,3 +99,42 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// kioskCookie holds the device key of an enrolled kiosk.
+const kioskCookie = "kiosk_key"
+
+// requireKiosk only lets enrolled kiosks through: the device key in their
+// kiosk_key cookie must belong to a kiosk that hasn't been revoked. It also
+// signs the patron out after kioskTimeout without activity.
+func (app *application) requireKiosk(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(kioskCookie)
+		if err != nil {
+			http.Redirect(w, r, "/kiosk/enrol", http.StatusSeeOther)
+			return
+		}
+		kiosk, err := app.kiosks.Authenticate(cookie.Value)
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidCredentials) {
+				http.Redirect(w, r, "/kiosk/enrol", http.StatusSeeOther)
+			} else {
+				app.serverError(w, err)
+			}
+			return
+		}
+
+		if app.sessionManager.GetInt(r.Context(), "kioskPatronID") != 0 {
+			lastActive := time.Unix(app.sessionManager.GetInt64(r.Context(), "kioskLastActive"), 0)
+			if time.Since(lastActive) > app.kioskTimeout {
+				app.sessionManager.Remove(r.Context(), "kioskPatronID")
+				app.sessionManager.Put(r.Context(), "flash", "You were signed out after a period of inactivity.")
+			} else {
+				app.sessionManager.Put(r.Context(), "kioskLastActive", time.Now().Unix())
+			}
+		}
+
+		w.Header().Add("Cache-Control", "no-store")
+		ctx := context.WithValue(r.Context(), kioskContextKey, kiosk)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
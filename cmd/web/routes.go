@@ -39,6 +39,20 @@ func (app *application) routes() http.Handler {
 		r.Post("/user/login", app.userLoginPost)
 
 		r.Get("/books", app.bookList)
+		r.Get("/reserves", app.reserveList)
+		r.Get("/reserves/{id}", app.reserveView)
+
+		// self-service kiosk: patrons sign in with card and PIN, not a login
+		r.Get("/kiosk/enrol", app.kioskEnrol)
+		r.Post("/kiosk/enrol", app.kioskEnrolPost)
+		r.Group(func(r chi.Router) {
+			r.Use(app.requireKiosk)
+			r.Get("/kiosk", app.kiosk)
+			r.Post("/kiosk/login", app.kioskLoginPost)
+			r.Post("/kiosk/logout", app.kioskLogoutPost)
+			r.Post("/kiosk/scan", app.kioskScanPost)
+			r.Post("/kiosk/loans/{id}/return", app.kioskReturnPost)
+		})
 
 		r.Group(func(r chi.Router) {
 			r.Use(app.requireAuthentication)
@@ -47,16 +61,77 @@ func (app *application) routes() http.Handler {
 			r.Get("/user/logout-confirm", app.userLogoutConfirm)
 
 			r.Get("/my-books", app.myBooks)
+			r.Get("/my-books/history", app.myHistory)
+			r.Post("/my-books/history/settings", app.myHistorySettingsPost)
+			r.Post("/my-branch", app.myBranchPost)
 			r.Post("/books/{id}/issue", app.issueBookPost)
 			r.Post("/issues/{id}/return", app.returnBookPost)
+			r.Post("/issues/{id}/renew", app.renewIssuePost)
+			r.Post("/books/{id}/hold", app.placeHoldPost)
+			r.Get("/my-holds", app.myHolds)
+			r.Post("/my-holds/{id}/cancel", app.myHoldCancelPost)
+			r.Post("/books/{id}/subscribe", app.subscribePost)
+			r.Get("/my-subscriptions", app.mySubscriptions)
+			r.Post("/my-subscriptions/{id}/cancel", app.mySubscriptionCancelPost)
+			r.Get("/suggestions", app.mySuggestions)
+			r.Post("/suggestions", app.suggestionPost)
+			r.Get("/notifications", app.myNotifications)
 
 			// librarian routes
 			r.Group(func(r chi.Router) {
 				r.Use(app.requireLibrarian)
 				r.Get("/books/new", app.bookCreateForm)
 				r.Post("/books/new", app.bookCreatePost)
-				r.Post("/books/{id}/delete", app.bookDeletePost)
+				r.Post("/books/{id}/withdraw", app.bookWithdrawPost)
+				r.Post("/books/{id}/restore", app.bookRestorePost)
+				r.Get("/books/{id}/copies", app.bookCopies)
+				r.Post("/books/{id}/copies", app.bookCopyAddPost)
+				r.Post("/books/{id}/replacement-cost", app.bookReplacementCostPost)
+				r.Post("/books/{id}/item-type", app.bookItemTypePost)
+				r.Post("/copies/{id}", app.copyUpdatePost)
+				r.Post("/reserves", app.reservePost)
+				r.Post("/reserves/{id}/books", app.reserveBookPost)
+				r.Post("/reserves/{id}/books/{bookID}/remove", app.reserveBookRemovePost)
 				r.Get("/issues", app.allIssues)
+				r.Get("/checkin", app.checkinLookup)
+				r.Get("/issues/{id}/checkin", app.checkinForm)
+				r.Post("/issues/{id}/checkin", app.checkinPost)
+				r.Post("/issues/{id}/loss", app.declareLossPost)
+				r.Post("/issues/{id}/found", app.reverseLossPost)
+				r.Post("/issues/{id}/recall", app.recallPost)
+				r.Get("/circulation", app.circulation)
+				r.Post("/circulation/patron", app.circulationPatronPost)
+				r.Post("/circulation/items", app.circulationItemPost)
+				r.Post("/circulation/clear", app.circulationClearPost)
+				r.Get("/transfers", app.allTransfers)
+				r.Post("/transfers/receive", app.transferReceivePost)
+				r.Get("/holds", app.allHolds)
+				r.Post("/holds/{id}/cancel", app.holdCancelPost)
+				r.Get("/fines", app.allFines)
+				r.Get("/fines/{id}", app.fineView)
+				r.Post("/fines/{id}/entries", app.fineEntryPost)
+				r.Get("/desk", app.deskSearch)
+				r.Get("/desk/patrons/{id}", app.deskPatron)
+				r.Post("/desk/patrons/{id}/checkout", app.deskCheckoutPost)
+				r.Post("/desk/patrons/{id}/card", app.deskCardNumberPost)
+				r.Post("/desk/patrons/{id}/pin", app.deskPINPost)
+				r.Post("/desk/patrons/{id}/membership", app.deskMembershipPost)
+				r.Post("/desk/patrons/{id}/blocks", app.deskBlockPost)
+				r.Post("/desk/patrons/{id}/blocks/{blockID}/lift", app.deskLiftBlockPost)
+				r.Get("/patrons/{id}", app.patronView)
+				r.Post("/patrons/{id}/loans/{issueID}/checkin", app.patronCheckInPost)
+				r.Post("/patrons/{id}/loans/{issueID}/renew", app.patronRenewPost)
+				r.Post("/patrons/{id}/fines/{fineID}/waive", app.patronWaivePost)
+				r.Post("/patrons/{id}/messages", app.patronMessagePost)
+				r.Post("/patrons/{id}/notes", app.patronNotePost)
+				r.Get("/notices", app.overdueNotices)
+				r.Get("/acquisitions", app.acquisitions)
+				r.Get("/acquisitions/budget", app.acquisitionBudget)
+				r.Get("/acquisitions/{id}", app.acquisitionView)
+				r.Post("/acquisitions/{id}/approve", app.acquisitionApprovePost)
+				r.Post("/acquisitions/{id}/reject", app.acquisitionRejectPost)
+				r.Post("/acquisitions/{id}/order", app.acquisitionOrderPost)
+				r.Post("/acquisitions/{id}/receive", app.acquisitionReceivePost)
 			})
 
 			// admin routes
@@ -64,6 +139,23 @@ func (app *application) routes() http.Handler {
 				r.Use(app.requireAdmin)
 				r.Get("/admin/users", app.adminUsers)
 				r.Post("/admin/users/{id}/promote", app.adminPromotePost)
+				r.Get("/admin/loan-policies", app.adminLoanPolicies)
+				r.Post("/admin/loan-policies/{role}", app.adminLoanPolicyPost)
+				r.Get("/admin/item-types", app.adminItemTypes)
+				r.Post("/admin/item-types", app.adminItemTypePost)
+				r.Post("/admin/item-types/{id}", app.adminItemTypeUpdatePost)
+				r.Get("/admin/calendar", app.adminCalendar)
+				r.Post("/admin/calendar/opening-days", app.adminOpeningDaysPost)
+				r.Post("/admin/calendar/closures", app.adminClosurePost)
+				r.Post("/admin/calendar/closures/{id}/delete", app.adminClosureDeletePost)
+				r.Post("/admin/books/{id}/purge", app.adminBookPurgePost)
+				r.Get("/admin/branches", app.adminBranches)
+				r.Post("/admin/branches", app.adminBranchPost)
+				r.Post("/admin/users/{id}/branches", app.adminStaffBranchesPost)
+				r.Get("/admin/kiosks", app.adminKiosks)
+				r.Post("/admin/kiosks", app.adminKioskPost)
+				r.Post("/admin/kiosks/{id}/revoke", app.adminKioskRevokePost)
+				r.Post("/acquisitions/budget", app.acquisitionBudgetPost)
 			})
 		})
 	})
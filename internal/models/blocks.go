@@ -0,0 +1,147 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type PatronBlockModelInterface interface {
+	Add(userID, staffID int, reason string) (int, error)
+	GetActive(userID int) ([]*PatronBlock, error)
+	Lift(id, userID, staffID int) error
+}
+
+// PatronBlock suspends a patron's borrowing until staff lift it.
+type PatronBlock struct {
+	ID      int
+	UserID  int
+	Reason  string
+	Created time.Time
+	// CreatedByName is the staff member who added the block; empty for
+	// blocks added by the overdue processor.
+	CreatedByName string
+}
+
+type PatronBlockModel struct {
+	DB *sql.DB
+}
+
+// Add blocks the user by hand, e.g. because they have left the school.
+func (m *PatronBlockModel) Add(userID, staffID int, reason string) (int, error) {
+	result, err := m.DB.Exec(
+		`INSERT INTO patron_blocks (user_id, reason, created, created_by) VALUES (?, ?, NOW(), ?)`,
+		userID, reason, staffID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *PatronBlockModel) GetActive(userID int) ([]*PatronBlock, error) {
+	stmt := `SELECT b.id, b.user_id, b.reason, b.created, COALESCE(s.name, '') FROM patron_blocks b
+             LEFT JOIN users s ON s.id = b.created_by
+             WHERE b.user_id = ? AND b.lifted_at IS NULL ORDER BY b.created`
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []*PatronBlock
+	for rows.Next() {
+		b := &PatronBlock{}
+		err := rows.Scan(&b.ID, &b.UserID, &b.Reason, &b.Created, &b.CreatedByName)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// Lift ends one of the user's active blocks, recording the staff member who
+// lifted it.
+func (m *PatronBlockModel) Lift(id, userID, staffID int) error {
+	result, err := m.DB.Exec(
+		`UPDATE patron_blocks SET lifted_at = NOW(), lifted_by = ? WHERE id = ? AND user_id = ? AND lifted_at IS NULL`,
+		staffID, id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// suspend blocks the user's borrowing for reason. A user already blocked for
+// the same reason isn't blocked twice.
+func suspend(q querier, userID int, reason string) error {
+	var blocked bool
+	err := q.QueryRow(
+		`SELECT EXISTS(SELECT true FROM patron_blocks WHERE user_id = ? AND reason = ? AND lifted_at IS NULL)`,
+		userID, reason,
+	).Scan(&blocked)
+	if err != nil || blocked {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO patron_blocks (user_id, reason, created) VALUES (?, ?, NOW())`, userID, reason)
+	return err
+}
+
+// suspended reports whether the user has any active block.
+func suspended(q querier, userID int) (bool, error) {
+	var blocked bool
+	err := q.QueryRow(
+		`SELECT EXISTS(SELECT true FROM patron_blocks WHERE user_id = ? AND lifted_at IS NULL)`,
+		userID,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// accountBlock returns ErrBorrowingSuspended or ErrMembershipExpired if the
+// user's account stops them renewing loans or placing holds, or nil.
+func accountBlock(q querier, userID int) error {
+	blocked, err := suspended(q, userID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBorrowingSuspended
+	}
+	expired, err := membershipExpired(q, userID)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return ErrMembershipExpired
+	}
+	return nil
+}
+
+// liftOverdueSuspension lifts the overdue processor's suspension once the
+// user has returned every loan that got a final notice. staffID is whoever
+// closed the last such loan, or 0.
+func liftOverdueSuspension(q querier, userID, staffID int) error {
+	var stillOut bool
+	err := q.QueryRow(
+		`SELECT EXISTS(SELECT true FROM issues i JOIN overdue_notices n ON n.issue_id = i.id
+         WHERE i.user_id = ? AND i.returned_at IS NULL AND n.level = 'final')`,
+		userID,
+	).Scan(&stillOut)
+	if err != nil || stillOut {
+		return err
+	}
+	_, err = q.Exec(
+		`UPDATE patron_blocks SET lifted_at = NOW(), lifted_by = ? WHERE user_id = ? AND reason = ? AND lifted_at IS NULL`,
+		nullableID(staffID), userID, suspendedOverdue,
+	)
+	return err
+}
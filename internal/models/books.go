@@ -3,19 +3,28 @@ package models
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 type BookModelInterface interface {
-	Insert(title, author, isbn string, totalCopies int) (int, error)
+	Insert(title, author, isbn string, totalCopies, replacementCost, branchID, itemTypeID int) (int, error)
 	Get(id int) (*Book, error)
-	Delete(id int) error
-	Search(query string) ([]*Book, error)
-	List() ([]*Book, error)
-	DecrementAvailable(id int) error
-	IncrementAvailable(id int) error
+	GetByISBN(isbn string) (*Book, error)
+	SetReplacementCost(id, cents int) error
+	SetItemType(id, itemTypeID int) error
+	Withdraw(id int) error
+	Restore(id int) error
+	Purge(id int) error
+	Search(query string, withdrawn bool, itemTypeID int) ([]*Book, error)
+	List(withdrawn bool, itemTypeID int) ([]*Book, error)
 }
 
+// Book is a title in the catalogue. Copy counts are derived from the status of
+// its rows in book_copies.
 type Book struct {
 	ID              int
 	Title           string
@@ -23,28 +32,82 @@ type Book struct {
 	ISBN            string
 	TotalCopies     int
 	AvailableCopies int
-	Created         time.Time
+	// ReplacementCost, in cents, is charged when a copy is lost or damaged on
+	// loan, unless the copy has its own cost.
+	ReplacementCost int
+	ItemTypeID      int
+	ItemType        string
+	// Loanable is false for reference items, which can't be borrowed.
+	Loanable bool
+	Created  time.Time
+	// WithdrawnAt is set once the book has been taken out of the catalogue.
+	// Its loans and history are kept.
+	WithdrawnAt *time.Time
 }
 
 type BookModel struct {
 	DB *sql.DB
 }
 
-func (m *BookModel) Insert(title, author, isbn string, totalCopies int) (int, error) {
-	stmt := `INSERT INTO books (title, author, isbn, total_copies, available_copies, created)
-             VALUES (?, ?, ?, ?, ?, NOW())`
-	result, err := m.DB.Exec(stmt, title, author, isbn, totalCopies, totalCopies)
+// Insert adds the book, classified as itemTypeID, along with totalCopies
+// copies at the branch, each given a generated barcode.
+func (m *BookModel) Insert(title, author, isbn string, totalCopies, replacementCost, branchID, itemTypeID int) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertBook(tx, title, author, isbn, totalCopies, replacementCost, branchID, itemTypeID)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertBook adds a book and its copies at branchID. It fails with
+// ErrDuplicateISBN if the ISBN is already in the catalogue.
+func insertBook(q querier, title, author, isbn string, totalCopies, replacementCost, branchID, itemTypeID int) (int, error) {
+	stmt := `INSERT INTO books (title, author, isbn, replacement_cost, item_type_id, created) VALUES (?, ?, ?, ?, ?, NOW())`
+	result, err := q.Exec(stmt, title, author, isbn, replacementCost, itemTypeID)
 	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "books_uc_isbn") {
+				return 0, ErrDuplicateISBN
+			}
+		}
 		return 0, err
 	}
 	id, err := result.LastInsertId()
-	return int(id), err
+	if err != nil {
+		return 0, err
+	}
+
+	for n := 1; n <= totalCopies; n++ {
+		_, err = insertCopy(q, int(id), branchID, defaultBarcode(int(id), n), "")
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int(id), nil
 }
 
 func (m *BookModel) Get(id int) (*Book, error) {
 	b := &Book{}
-	stmt := `SELECT id, title, author, isbn, total_copies, available_copies, created FROM books WHERE id = ?`
-	err := m.DB.QueryRow(stmt, id).Scan(&b.ID, &b.Title, &b.Author, &b.ISBN, &b.TotalCopies, &b.AvailableCopies, &b.Created)
+	err := m.DB.QueryRow(bookSelect+` WHERE b.id = ?`, id).Scan(bookFields(b)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (m *BookModel) GetByISBN(isbn string) (*Book, error) {
+	b := &Book{}
+	err := m.DB.QueryRow(bookSelect+` WHERE b.isbn = ?`, isbn).Scan(bookFields(b)...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -54,22 +117,198 @@ func (m *BookModel) Get(id int) (*Book, error) {
 	return b, nil
 }
 
-func (m *BookModel) Delete(id int) error {
-	// remove issues first to satisfy FK constraint
-	_, err := m.DB.Exec("DELETE FROM issues WHERE book_id = ?", id)
+func (m *BookModel) SetReplacementCost(id, cents int) error {
+	result, err := m.DB.Exec(`UPDATE books SET replacement_cost = ? WHERE id = ?`, cents, id)
 	if err != nil {
 		return err
 	}
-	_, err = m.DB.Exec("DELETE FROM books WHERE id = ?", id)
-	return err
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var exists bool
+		err = m.DB.QueryRow(`SELECT EXISTS(SELECT true FROM books WHERE id = ?)`, id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// SetItemType reclassifies the book. Loans already out keep their due dates.
+func (m *BookModel) SetItemType(id, itemTypeID int) error {
+	result, err := m.DB.Exec(`UPDATE books SET item_type_id = ? WHERE id = ?`, itemTypeID, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		_, err = m.Get(id)
+		return err
+	}
+	return nil
 }
 
-func (m *BookModel) Search(query string) ([]*Book, error) {
+// Withdraw takes the book out of the catalogue while keeping its loans and
+// history. It fails with ErrBookOnLoan while any loan of the book is still
+// out. Holds and subscriptions on the book are cancelled, their patrons
+// notified, and any copies set aside for holds go back to available.
+func (m *BookModel) Withdraw(id int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockBook(tx, id)
+	if err != nil {
+		return err
+	}
+
+	var title string
+	var withdrawn, onLoan bool
+	err = tx.QueryRow(
+		`SELECT title, withdrawn_at IS NOT NULL,
+         EXISTS(SELECT true FROM issues WHERE book_id = ? AND returned_at IS NULL)
+         FROM books WHERE id = ?`,
+		id, id,
+	).Scan(&title, &withdrawn, &onLoan)
+	if err != nil {
+		return err
+	}
+	if withdrawn {
+		return nil
+	}
+	if onLoan {
+		return ErrBookOnLoan
+	}
+
+	rows, err := tx.Query(`SELECT user_id FROM holds WHERE book_id = ? AND status IN ('waiting', 'ready') FOR UPDATE`, id)
+	if err != nil {
+		return err
+	}
+	var holders []int
+	for rows.Next() {
+		var userID int
+		err = rows.Scan(&userID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		holders = append(holders, userID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		`UPDATE holds SET status = 'cancelled', closed_at = NOW() WHERE book_id = ? AND status IN ('waiting', 'ready')`,
+		`UPDATE book_copies SET status = 'available' WHERE book_id = ? AND status = 'on_hold'`,
+		`UPDATE books SET withdrawn_at = NOW() WHERE id = ?`,
+	} {
+		_, err = tx.Exec(stmt, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, userID := range holders {
+		err = notify(tx, userID, fmt.Sprintf("%q has been withdrawn from the library, so your hold on it was cancelled.", title))
+		if err != nil {
+			return err
+		}
+	}
+	err = endSubscriptions(tx, id, "%q has been withdrawn from the library, so it won't be coming back on the shelf.")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Restore puts a withdrawn book back in the catalogue.
+func (m *BookModel) Restore(id int) error {
+	result, err := m.DB.Exec(`UPDATE books SET withdrawn_at = NULL WHERE id = ? AND withdrawn_at IS NOT NULL`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		_, err = m.Get(id)
+		if err != nil {
+			return err
+		}
+		return ErrNotWithdrawn
+	}
+	return nil
+}
+
+// Purge deletes a withdrawn book and its copies for good, taking it off any
+// course reserve lists and unlinking the suggestion it was ordered for. It
+// is only for books entered by mistake: it fails with ErrBookHasHistory if
+// the book has ever been lent, and with ErrNotWithdrawn unless it was
+// withdrawn first.
+func (m *BookModel) Purge(id int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockBook(tx, id)
+	if err != nil {
+		return err
+	}
+
+	var withdrawn, lent bool
+	err = tx.QueryRow(
+		`SELECT withdrawn_at IS NOT NULL, EXISTS(SELECT true FROM issues WHERE book_id = ?) FROM books WHERE id = ?`,
+		id, id,
+	).Scan(&withdrawn, &lent)
+	if err != nil {
+		return err
+	}
+	if !withdrawn {
+		return ErrNotWithdrawn
+	}
+	if lent {
+		return ErrBookHasHistory
+	}
+
+	// remove dependent rows first to satisfy FK constraints
+	for _, stmt := range []string{
+		"DELETE FROM holds WHERE book_id = ?",
+		"DELETE FROM book_subscriptions WHERE book_id = ?",
+		"DELETE FROM course_reserve_books WHERE book_id = ?",
+		"UPDATE purchase_suggestions SET book_id = NULL WHERE book_id = ?",
+		"DELETE FROM book_copies WHERE book_id = ?",
+		"DELETE FROM books WHERE id = ?",
+	} {
+		_, err = tx.Exec(stmt, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Search matches the title, author or ISBN among catalogue books, or among
+// withdrawn ones if withdrawn is set. A non-zero itemTypeID limits it to
+// books of that type.
+func (m *BookModel) Search(query string, withdrawn bool, itemTypeID int) ([]*Book, error) {
 	like := "%" + query + "%"
-	stmt := `SELECT id, title, author, isbn, total_copies, available_copies, created
-             FROM books WHERE title LIKE ? OR author LIKE ? OR isbn LIKE ?
-             ORDER BY title`
-	rows, err := m.DB.Query(stmt, like, like, like)
+	stmt := bookSelect + ` WHERE (b.withdrawn_at IS NOT NULL) = ? AND (b.title LIKE ? OR b.author LIKE ? OR b.isbn LIKE ?)
+             AND (? = 0 OR b.item_type_id = ?) ORDER BY b.title`
+	rows, err := m.DB.Query(stmt, withdrawn, like, like, like, itemTypeID, itemTypeID)
 	if err != nil {
 		return nil, err
 	}
@@ -77,8 +316,13 @@ func (m *BookModel) Search(query string) ([]*Book, error) {
 	return scanBooks(rows)
 }
 
-func (m *BookModel) List() ([]*Book, error) {
-	rows, err := m.DB.Query(`SELECT id, title, author, isbn, total_copies, available_copies, created FROM books ORDER BY title`)
+// List returns the catalogue, or the withdrawn books if withdrawn is set. A
+// non-zero itemTypeID limits it to books of that type.
+func (m *BookModel) List(withdrawn bool, itemTypeID int) ([]*Book, error) {
+	rows, err := m.DB.Query(
+		bookSelect+` WHERE (b.withdrawn_at IS NOT NULL) = ? AND (? = 0 OR b.item_type_id = ?) ORDER BY b.title`,
+		withdrawn, itemTypeID, itemTypeID,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -86,21 +330,24 @@ func (m *BookModel) List() ([]*Book, error) {
 	return scanBooks(rows)
 }
 
-func (m *BookModel) DecrementAvailable(id int) error {
-	_, err := m.DB.Exec("UPDATE books SET available_copies = available_copies - 1 WHERE id = ? AND available_copies > 0", id)
-	return err
-}
+// bookSelect counts every copy still in the collection towards the total, and
+// only copies on the shelf as available.
+const bookSelect = `SELECT b.id, b.title, b.author, b.isbn,
+             (SELECT COUNT(*) FROM book_copies c WHERE c.book_id = b.id AND c.status NOT IN ('lost', 'withdrawn')),
+             (SELECT COUNT(*) FROM book_copies c WHERE c.book_id = b.id AND c.status = 'available'),
+             b.replacement_cost, b.item_type_id, t.name, t.loanable, b.created, b.withdrawn_at
+             FROM books b
+             JOIN item_types t ON t.id = b.item_type_id`
 
-func (m *BookModel) IncrementAvailable(id int) error {
-	_, err := m.DB.Exec("UPDATE books SET available_copies = available_copies + 1 WHERE id = ?", id)
-	return err
+func bookFields(b *Book) []any {
+	return []any{&b.ID, &b.Title, &b.Author, &b.ISBN, &b.TotalCopies, &b.AvailableCopies, &b.ReplacementCost, &b.ItemTypeID, &b.ItemType, &b.Loanable, &b.Created, &b.WithdrawnAt}
 }
 
 func scanBooks(rows *sql.Rows) ([]*Book, error) {
 	var books []*Book
 	for rows.Next() {
 		b := &Book{}
-		err := rows.Scan(&b.ID, &b.Title, &b.Author, &b.ISBN, &b.TotalCopies, &b.AvailableCopies, &b.Created)
+		err := rows.Scan(bookFields(b)...)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type BranchModelInterface interface {
+	Insert(name string) (int, error)
+	Get(id int) (*Branch, error)
+	List() ([]*Branch, error)
+	ManagedBy(userID int) ([]*Branch, error)
+	SetManaged(userID int, branchIDs []int) error
+	Staff() ([]*BranchStaff, error)
+	Availability() (map[int][]*BranchAvailability, error)
+}
+
+// Branch is one library site, e.g. the main library or a departmental
+// reading room. Every copy has a home branch.
+type Branch struct {
+	ID      int
+	Name    string
+	Created time.Time
+}
+
+// BranchStaff is a librarian with the branches they manage.
+type BranchStaff struct {
+	UserID    int
+	Name      string
+	Email     string
+	BranchIDs []int
+}
+
+// Manages reports whether the librarian manages the branch.
+func (s *BranchStaff) Manages(branchID int) bool {
+	for _, id := range s.BranchIDs {
+		if id == branchID {
+			return true
+		}
+	}
+	return false
+}
+
+// BranchAvailability counts a book's copies at one branch, the same way
+// Book counts them across the whole collection.
+type BranchAvailability struct {
+	BranchID        int
+	BranchName      string
+	TotalCopies     int
+	AvailableCopies int
+}
+
+type BranchModel struct {
+	DB *sql.DB
+}
+
+func (m *BranchModel) Insert(name string) (int, error) {
+	result, err := m.DB.Exec(`INSERT INTO branches (name, created) VALUES (?, NOW())`, name)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "branches_uc_name") {
+				return 0, ErrDuplicateBranch
+			}
+		}
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *BranchModel) Get(id int) (*Branch, error) {
+	b := &Branch{}
+	err := m.DB.QueryRow(`SELECT id, name, created FROM branches WHERE id = ?`, id).Scan(&b.ID, &b.Name, &b.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (m *BranchModel) List() ([]*Branch, error) {
+	rows, err := m.DB.Query(`SELECT id, name, created FROM branches ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBranches(rows)
+}
+
+// ManagedBy returns the branches a librarian manages. Admins manage every
+// branch whether or not they are listed.
+func (m *BranchModel) ManagedBy(userID int) ([]*Branch, error) {
+	rows, err := m.DB.Query(
+		`SELECT b.id, b.name, b.created FROM branches b
+         JOIN librarian_branches lb ON lb.branch_id = b.id
+         WHERE lb.user_id = ? ORDER BY b.name`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBranches(rows)
+}
+
+// SetManaged replaces the branches a librarian manages.
+func (m *BranchModel) SetManaged(userID int, branchIDs []int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM librarian_branches WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range branchIDs {
+		_, err = tx.Exec(`INSERT INTO librarian_branches (user_id, branch_id) VALUES (?, ?)`, userID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Staff lists every librarian with the branches they manage.
+func (m *BranchModel) Staff() ([]*BranchStaff, error) {
+	rows, err := m.DB.Query(
+		`SELECT u.id, u.name, u.email, COALESCE(lb.branch_id, 0) FROM users u
+         LEFT JOIN librarian_branches lb ON lb.user_id = u.id
+         WHERE u.role = 'librarian' ORDER BY u.name, u.id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var staff []*BranchStaff
+	for rows.Next() {
+		var s BranchStaff
+		var branchID int
+		err := rows.Scan(&s.UserID, &s.Name, &s.Email, &branchID)
+		if err != nil {
+			return nil, err
+		}
+		if len(staff) == 0 || staff[len(staff)-1].UserID != s.UserID {
+			staff = append(staff, &s)
+		}
+		if branchID != 0 {
+			last := staff[len(staff)-1]
+			last.BranchIDs = append(last.BranchIDs, branchID)
+		}
+	}
+	return staff, rows.Err()
+}
+
+// Availability returns the copy counts of every book at each branch that
+// holds copies of it, keyed by book ID.
+func (m *BranchModel) Availability() (map[int][]*BranchAvailability, error) {
+	rows, err := m.DB.Query(
+		`SELECT c.book_id, br.id, br.name,
+         SUM(c.status NOT IN ('lost', 'withdrawn')), SUM(c.status = 'available')
+         FROM book_copies c
+         JOIN branches br ON br.id = c.branch_id
+         GROUP BY c.book_id, br.id, br.name
+         HAVING SUM(c.status NOT IN ('lost', 'withdrawn')) > 0
+         ORDER BY br.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	availability := make(map[int][]*BranchAvailability)
+	for rows.Next() {
+		var bookID int
+		a := &BranchAvailability{}
+		err := rows.Scan(&bookID, &a.BranchID, &a.BranchName, &a.TotalCopies, &a.AvailableCopies)
+		if err != nil {
+			return nil, err
+		}
+		availability[bookID] = append(availability[bookID], a)
+	}
+	return availability, rows.Err()
+}
+
+func scanBranches(rows *sql.Rows) ([]*Branch, error) {
+	var branches []*Branch
+	for rows.Next() {
+		b := &Branch{}
+		err := rows.Scan(&b.ID, &b.Name, &b.Created)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, b)
+	}
+	return branches, rows.Err()
+}
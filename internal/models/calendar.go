@@ -0,0 +1,225 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type CalendarModelInterface interface {
+	OpeningDays() ([]time.Weekday, error)
+	SetOpeningDays(days []time.Weekday) error
+	Closures() ([]*Closure, error)
+	AddClosure(startsOn, endsOn time.Time, reason string) (int, error)
+	DeleteClosure(id int) error
+}
+
+// Closure is a one-off run of days the library is shut, e.g. a public
+// holiday or an exam break. Both ends are inclusive.
+type Closure struct {
+	ID       int
+	StartsOn time.Time
+	EndsOn   time.Time
+	Reason   string
+	Created  time.Time
+}
+
+type CalendarModel struct {
+	DB *sql.DB
+}
+
+// OpeningDays returns the weekdays the library is normally open, Sunday
+// first.
+func (m *CalendarModel) OpeningDays() ([]time.Weekday, error) {
+	rows, err := m.DB.Query(`SELECT weekday FROM opening_days WHERE is_open ORDER BY weekday`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []time.Weekday
+	for rows.Next() {
+		var d int
+		err := rows.Scan(&d)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, time.Weekday(d))
+	}
+	return days, rows.Err()
+}
+
+// SetOpeningDays replaces the weekly schedule; weekdays not in days are
+// closed.
+func (m *CalendarModel) SetOpeningDays(days []time.Weekday) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	open := make(map[time.Weekday]bool)
+	for _, d := range days {
+		open[d] = true
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		_, err = tx.Exec(
+			`INSERT INTO opening_days (weekday, is_open) VALUES (?, ?) ON DUPLICATE KEY UPDATE is_open = VALUES(is_open)`,
+			int(d), open[d],
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Closures returns closures that haven't ended yet, soonest first.
+func (m *CalendarModel) Closures() ([]*Closure, error) {
+	rows, err := m.DB.Query(closureSelect + ` WHERE ends_on >= CURDATE() ORDER BY starts_on`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanClosures(rows)
+}
+
+func (m *CalendarModel) AddClosure(startsOn, endsOn time.Time, reason string) (int, error) {
+	result, err := m.DB.Exec(
+		`INSERT INTO closures (starts_on, ends_on, reason, created) VALUES (?, ?, ?, NOW())`,
+		startsOn.Format("2006-01-02"), endsOn.Format("2006-01-02"), reason,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *CalendarModel) DeleteClosure(id int) error {
+	result, err := m.DB.Exec(`DELETE FROM closures WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// calendar answers whether the library is open on a given day. Days are
+// compared by their calendar date only.
+type calendar struct {
+	open     [7]bool
+	closures []*Closure
+}
+
+// loadCalendar reads the weekly schedule and every closure that ends on or
+// after from.
+func loadCalendar(q querier, from time.Time) (*calendar, error) {
+	c := &calendar{}
+	err := c.loadOpeningDays(q)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(closureSelect+` WHERE ends_on >= ?`, from.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c.closures, err = scanClosures(rows)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *calendar) loadOpeningDays(q querier) error {
+	rows, err := q.Query(`SELECT weekday FROM opening_days WHERE is_open`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d int
+		err := rows.Scan(&d)
+		if err != nil {
+			return err
+		}
+		c.open[d] = true
+	}
+	return rows.Err()
+}
+
+func (c *calendar) isOpen(t time.Time) bool {
+	day := dateOf(t)
+	if !c.open[day.Weekday()] {
+		return false
+	}
+	for _, cl := range c.closures {
+		if !day.Before(dateOf(cl.StartsOn)) && !day.After(dateOf(cl.EndsOn)) {
+			return false
+		}
+	}
+	return true
+}
+
+// nextOpen rolls t forward, keeping its time of day, to the first day the
+// library is open. A calendar with no opening days at all leaves t alone
+// rather than searching forever.
+func (c *calendar) nextOpen(t time.Time) time.Time {
+	if c.open == [7]bool{} {
+		return t
+	}
+	// closures can't realistically run for years; stop looking after one
+	for i := 0; i < 366 && !c.isOpen(t); i++ {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// openDaysBetween counts the days the library was open after from, up to and
+// including to.
+func (c *calendar) openDaysBetween(from, to time.Time) int {
+	n := 0
+	for d := dateOf(from).AddDate(0, 0, 1); !d.After(dateOf(to)); d = d.AddDate(0, 0, 1) {
+		if c.isOpen(d) {
+			n++
+		}
+	}
+	return n
+}
+
+// dueDateFrom is from plus days, rolled forward to the next open day.
+func dueDateFrom(q querier, from time.Time, days int) (time.Time, error) {
+	due := from.AddDate(0, 0, days)
+	c, err := loadCalendar(q, due)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.nextOpen(due), nil
+}
+
+// dateOf drops the time of day, keeping t's calendar date.
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+const closureSelect = `SELECT id, starts_on, ends_on, reason, created FROM closures`
+
+func scanClosures(rows *sql.Rows) ([]*Closure, error) {
+	var closures []*Closure
+	for rows.Next() {
+		cl := &Closure{}
+		err := rows.Scan(&cl.ID, &cl.StartsOn, &cl.EndsOn, &cl.Reason, &cl.Created)
+		if err != nil {
+			return nil, err
+		}
+		closures = append(closures, cl)
+	}
+	return closures, rows.Err()
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type CopyModelInterface interface {
+	Get(id int) (*Copy, error)
+	GetByBarcode(barcode string) (*Copy, error)
+	GetByBook(bookID int) ([]*Copy, error)
+	Add(bookID, branchID int, barcode, location string) (int, error)
+	Update(id int, location, status string, replacementCost *int) error
+}
+
+// Copy statuses. on_loan, on_hold and in_transit are managed by
+// circulation; the rest can be set by staff.
+const (
+	CopyAvailable = "available"
+	CopyOnLoan    = "on_loan"
+	CopyOnHold    = "on_hold"
+	CopyLost      = "lost"
+	CopyDamaged   = "damaged"
+	CopyInRepair  = "in_repair"
+	CopyWithdrawn = "withdrawn"
+	// CopyInTransit is a copy returned at another branch on its way home.
+	CopyInTransit = "in_transit"
+)
+
+// CopyStaffStatuses are the statuses staff can put a copy into by hand.
+var CopyStaffStatuses = []string{CopyAvailable, CopyLost, CopyDamaged, CopyInRepair, CopyWithdrawn}
+
+// Copy is one physical item of a book.
+type Copy struct {
+	ID        int
+	BookID    int
+	BookTitle string
+	// BranchID is the copy's home branch.
+	BranchID   int
+	BranchName string
+	Barcode    string
+	Location   string
+	Status     string
+	// ReplacementCost overrides the book's replacement cost when set.
+	ReplacementCost *int
+	Created         time.Time
+}
+
+type CopyModel struct {
+	DB *sql.DB
+	// HoldPickupDays is how long a copy put back into circulation is kept
+	// for the next hold.
+	HoldPickupDays int
+}
+
+func (m *CopyModel) Get(id int) (*Copy, error) {
+	c := &Copy{}
+	err := m.DB.QueryRow(copySelect+` WHERE c.id = ?`, id).Scan(copyFields(c)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *CopyModel) GetByBarcode(barcode string) (*Copy, error) {
+	c := &Copy{}
+	err := m.DB.QueryRow(copySelect+` WHERE c.barcode = ?`, barcode).Scan(copyFields(c)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *CopyModel) GetByBook(bookID int) ([]*Copy, error) {
+	rows, err := m.DB.Query(copySelect+` WHERE c.book_id = ? ORDER BY c.barcode`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copies []*Copy
+	for rows.Next() {
+		c := &Copy{}
+		err := rows.Scan(copyFields(c)...)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+// Add puts a new copy of the book into circulation at the branch. An empty
+// barcode gets a generated one. Like a returned copy, it goes to the next
+// hold if anyone is waiting.
+func (m *CopyModel) Add(bookID, branchID int, barcode, location string) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = lockBook(tx, bookID)
+	if err != nil {
+		return 0, err
+	}
+	if barcode == "" {
+		var n int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM book_copies WHERE book_id = ?`, bookID).Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+		barcode = defaultBarcode(bookID, n+1)
+	}
+
+	id, err := insertCopy(tx, bookID, branchID, barcode, location)
+	if err != nil {
+		return 0, err
+	}
+	err = releaseCopy(tx, id, m.HoldPickupDays)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// Update changes a copy's shelf location, status and replacement cost (nil
+// to use the book's). Copies on loan, held for a patron or in transit can't
+// change status here; a copy made available again is offered to the hold
+// queue first.
+func (m *CopyModel) Update(id int, location, status string, replacementCost *int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := lockCopy(tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE book_copies SET location = ?, replacement_cost = ? WHERE id = ?`, location, replacementCost, id)
+	if err != nil {
+		return err
+	}
+
+	if status != current {
+		if current == CopyOnLoan || current == CopyOnHold || current == CopyInTransit {
+			return ErrCopyInUse
+		}
+		if status == CopyAvailable {
+			err = releaseCopy(tx, id, m.HoldPickupDays)
+		} else {
+			_, err = tx.Exec(`UPDATE book_copies SET status = ? WHERE id = ?`, status, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertCopy(q querier, bookID, branchID int, barcode, location string) (int, error) {
+	result, err := q.Exec(
+		`INSERT INTO book_copies (book_id, branch_id, barcode, location, status, created) VALUES (?, ?, ?, ?, 'available', NOW())`,
+		bookID, branchID, barcode, location,
+	)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "book_copies_uc_barcode") {
+				return 0, ErrDuplicateBarcode
+			}
+		}
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// defaultBarcode numbers copies per book, e.g. B000042-003. The migration in
+// migrations/book_copies.sql uses the same format.
+func defaultBarcode(bookID, n int) string {
+	return fmt.Sprintf("B%06d-%03d", bookID, n)
+}
+
+// lockCopy locks the copy's book and then the copy itself, and returns the
+// copy's current status.
+func lockCopy(tx *sql.Tx, copyID int) (string, error) {
+	var bookID int
+	err := tx.QueryRow(`SELECT book_id FROM book_copies WHERE id = ?`, copyID).Scan(&bookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoRecord
+		}
+		return "", err
+	}
+	err = lockBook(tx, bookID)
+	if err != nil {
+		return "", err
+	}
+	var status string
+	err = tx.QueryRow(`SELECT status FROM book_copies WHERE id = ? FOR UPDATE`, copyID).Scan(&status)
+	return status, err
+}
+
+const copySelect = `SELECT c.id, c.book_id, b.title, c.branch_id, br.name, c.barcode, c.location, c.status, c.replacement_cost, c.created
+             FROM book_copies c
+             JOIN books b ON b.id = c.book_id
+             JOIN branches br ON br.id = c.branch_id`
+
+func copyFields(c *Copy) []any {
+	return []any{&c.ID, &c.BookID, &c.BookTitle, &c.BranchID, &c.BranchName, &c.Barcode, &c.Location, &c.Status, &c.ReplacementCost, &c.Created}
+}
@@ -3,7 +3,42 @@ package models
 import "errors"
 
 var (
-	ErrNoRecord           = errors.New("models: no matching record found")
-	ErrInvalidCredentials = errors.New("models: invalid credentials")
-	ErrDuplicateEmail     = errors.New("models: duplicate email")
+	ErrNoRecord            = errors.New("models: no matching record found")
+	ErrInvalidCredentials  = errors.New("models: invalid credentials")
+	ErrDuplicateEmail      = errors.New("models: duplicate email")
+	ErrNoCopiesAvailable   = errors.New("models: no copies available")
+	ErrAlreadyIssued       = errors.New("models: book already issued to user")
+	ErrRenewalLimitReached = errors.New("models: renewal limit reached")
+	ErrRenewalOverdue      = errors.New("models: loan is too far overdue to renew")
+	ErrHoldsPending        = errors.New("models: other patrons are waiting for this book")
+	ErrCopiesAvailable     = errors.New("models: copies are available to issue")
+	ErrAlreadyOnHold       = errors.New("models: user already has a hold on this book")
+	ErrFinesOutstanding    = errors.New("models: outstanding fines over the borrowing limit")
+	ErrExceedsBalance      = errors.New("models: amount exceeds outstanding balance")
+	ErrLoanLimitReached    = errors.New("models: maximum concurrent loans reached")
+	ErrNoLoanPolicy        = errors.New("models: no loan policy for user role")
+	ErrDuplicateCardNumber = errors.New("models: duplicate card number")
+	ErrInvalidReturnTime   = errors.New("models: return time must be between issue time and now")
+	ErrCopyInUse           = errors.New("models: copy is on loan, held for a patron or in transit")
+	ErrDuplicateBarcode    = errors.New("models: duplicate barcode")
+	ErrCopyUnavailable     = errors.New("models: copy is not available to issue")
+	ErrNotLost             = errors.New("models: loan was not closed as lost")
+	ErrBorrowingSuspended  = errors.New("models: borrowing suspended")
+	ErrRecalled            = errors.New("models: loan has been recalled")
+	ErrAlreadyRecalled     = errors.New("models: loan already recalled")
+	ErrBookOnLoan          = errors.New("models: book has copies on loan")
+	ErrBookWithdrawn       = errors.New("models: book has been withdrawn")
+	ErrNotWithdrawn        = errors.New("models: book is not withdrawn")
+	ErrBookHasHistory      = errors.New("models: book has circulation history")
+	ErrDuplicateBranch     = errors.New("models: duplicate branch name")
+	ErrWrongBranch         = errors.New("models: copy belongs to another branch")
+	ErrNoBranch            = errors.New("models: no branch to issue from")
+	ErrNotInTransit        = errors.New("models: copy is not in transit")
+	ErrDuplicateItemType   = errors.New("models: duplicate item type name")
+	ErrNotLoanable         = errors.New("models: item is for reference only")
+	ErrAlreadySubscribed   = errors.New("models: user already subscribed to this book")
+	ErrMembershipExpired   = errors.New("models: library membership has expired")
+	ErrSuggestionStage     = errors.New("models: suggestion is not at a stage that allows this")
+	ErrDuplicateISBN       = errors.New("models: duplicate ISBN")
+	ErrPINLocked           = errors.New("models: kiosk sign-in locked after too many wrong PINs")
 )
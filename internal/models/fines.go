@@ -0,0 +1,314 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type FineModelInterface interface {
+	Get(id int) (*Fine, error)
+	GetByUser(userID int) ([]*Fine, error)
+	GetOutstanding() ([]*Fine, error)
+	Balance(userID int) (int, error)
+	Ledger(fineID int) ([]*FineEntry, error)
+	Pay(fineID, staffID, amount int, reason string) error
+	Waive(fineID, staffID, amount int, reason string) error
+}
+
+// FineRules configures overdue charges. All amounts are in cents.
+type FineRules struct {
+	PerDay int
+	// Cap limits the overdue charge on a single loan; 0 means no cap.
+	Cap int
+	// BlockThreshold is the outstanding balance above which a patron can't
+	// issue more books.
+	BlockThreshold int
+}
+
+// Charge returns the overdue fine for a loan returned daysLate days late.
+func (r FineRules) Charge(daysLate int) int {
+	if daysLate <= 0 {
+		return 0
+	}
+	amount := daysLate * r.PerDay
+	if r.Cap > 0 && amount > r.Cap {
+		amount = r.Cap
+	}
+	return amount
+}
+
+// Fine kinds.
+const (
+	FineOverdue     = "overdue"
+	FineReplacement = "replacement"
+)
+
+// Fine ledger entry kinds. A refund returns money already paid when a charge
+// is reversed; it doesn't change what's outstanding.
+const (
+	EntryPayment = "payment"
+	EntryWaiver  = "waiver"
+	EntryRefund  = "refund"
+)
+
+type Fine struct {
+	ID        int
+	UserID    int
+	IssueID   *int
+	BookTitle string
+	UserName  string
+	Kind      string
+	DaysLate  int
+	Amount    int
+	Paid      int
+	Waived    int
+	Refunded  int
+	Created   time.Time
+}
+
+// Outstanding is what's still owed on the fine, in cents.
+func (f *Fine) Outstanding() int {
+	return f.Amount - f.Paid - f.Waived
+}
+
+type FineEntry struct {
+	ID        int
+	FineID    int
+	Kind      string
+	Amount    int
+	Reason    string
+	StaffName string
+	Created   time.Time
+}
+
+type FineModel struct {
+	DB *sql.DB
+}
+
+func (m *FineModel) Get(id int) (*Fine, error) {
+	f := &Fine{}
+	err := m.DB.QueryRow(fineSelect+` WHERE f.id = ?`, id).Scan(fineFields(f)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetByUser returns the user's fines that still have something owing.
+func (m *FineModel) GetByUser(userID int) ([]*Fine, error) {
+	rows, err := m.DB.Query(fineSelect+` WHERE f.user_id = ? HAVING paid + waived < f.amount ORDER BY f.created DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFines(rows)
+}
+
+func (m *FineModel) GetOutstanding() ([]*Fine, error) {
+	rows, err := m.DB.Query(fineSelect + ` HAVING paid + waived < f.amount ORDER BY u.name, f.created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanFines(rows)
+}
+
+func (m *FineModel) Balance(userID int) (int, error) {
+	return outstandingBalance(m.DB, userID)
+}
+
+func (m *FineModel) Ledger(fineID int) ([]*FineEntry, error) {
+	stmt := `SELECT p.id, p.fine_id, p.kind, p.amount, p.reason, u.name, p.created
+             FROM fine_payments p
+             JOIN users u ON u.id = p.staff_id
+             WHERE p.fine_id = ?
+             ORDER BY p.created`
+	rows, err := m.DB.Query(stmt, fineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*FineEntry
+	for rows.Next() {
+		e := &FineEntry{}
+		err := rows.Scan(&e.ID, &e.FineID, &e.Kind, &e.Amount, &e.Reason, &e.StaffName, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Pay records a full or partial payment taken by a staff member.
+func (m *FineModel) Pay(fineID, staffID, amount int, reason string) error {
+	return m.record(fineID, staffID, EntryPayment, amount, reason)
+}
+
+// Waive writes off some or all of a fine. reason should say why.
+func (m *FineModel) Waive(fineID, staffID, amount int, reason string) error {
+	return m.record(fineID, staffID, EntryWaiver, amount, reason)
+}
+
+func (m *FineModel) record(fineID, staffID int, kind string, amount int, reason string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID, outstanding int
+	err = tx.QueryRow(
+		`SELECT f.user_id, f.amount - COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind <> 'refund'), 0)
+         FROM fines f WHERE f.id = ? FOR UPDATE`,
+		fineID,
+	).Scan(&userID, &outstanding)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if amount > outstanding {
+		return ErrExceedsBalance
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO fine_payments (fine_id, kind, amount, reason, staff_id, created) VALUES (?, ?, ?, ?, ?, NOW())`,
+		fineID, kind, amount, reason, staffID,
+	)
+	if err != nil {
+		return err
+	}
+	// a settled fine no longer keeps its loan in the patron's history
+	err = forgetHistory(tx, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// outstandingBalance sums what the user still owes across all fines.
+func outstandingBalance(q querier, userID int) (int, error) {
+	var balance int
+	err := q.QueryRow(
+		`SELECT COALESCE(SUM(f.amount - COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind <> 'refund'), 0)), 0)
+         FROM fines f WHERE f.user_id = ?`,
+		userID,
+	).Scan(&balance)
+	return balance, err
+}
+
+// chargeOverdue adds an overdue fine for a loan returned late. Loans returned
+// on time, or under a zero rate, are left alone.
+func chargeOverdue(q querier, rules FineRules, issueID, userID int, dueDate, returnedAt time.Time) error {
+	days, err := daysLate(q, dueDate, returnedAt)
+	if err != nil {
+		return err
+	}
+	amount := rules.Charge(days)
+	if amount == 0 {
+		return nil
+	}
+	_, err = q.Exec(
+		`INSERT INTO fines (user_id, issue_id, kind, days_late, amount, created) VALUES (?, ?, 'overdue', ?, ?, NOW())`,
+		userID, issueID, days, amount,
+	)
+	return err
+}
+
+// chargeReplacement bills the patron for a copy lost or damaged on their loan.
+func chargeReplacement(q querier, issueID, userID, amount int) error {
+	if amount <= 0 {
+		return nil
+	}
+	_, err := q.Exec(
+		`INSERT INTO fines (user_id, issue_id, kind, amount, created) VALUES (?, ?, 'replacement', ?, NOW())`,
+		userID, issueID, amount,
+	)
+	return err
+}
+
+// reverseReplacement cancels the replacement charge on a loan: whatever is
+// still owed is waived and whatever was paid is refunded, both recorded
+// against staffID. Loans without a replacement charge are left alone.
+func reverseReplacement(tx *sql.Tx, issueID, staffID int, reason string) error {
+	var fineID, amount, paid, waived int
+	err := tx.QueryRow(
+		`SELECT f.id, f.amount,
+         COALESCE((SELECT SUM(IF(p.kind = 'refund', -p.amount, p.amount)) FROM fine_payments p
+                   WHERE p.fine_id = f.id AND p.kind IN ('payment', 'refund')), 0),
+         COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind = 'waiver'), 0)
+         FROM fines f WHERE f.issue_id = ? AND f.kind = 'replacement' FOR UPDATE`,
+		issueID,
+	).Scan(&fineID, &amount, &paid, &waived)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO fine_payments (fine_id, kind, amount, reason, staff_id, created) VALUES (?, ?, ?, ?, ?, NOW())`
+	if owed := amount - paid - waived; owed > 0 {
+		_, err = tx.Exec(stmt, fineID, EntryWaiver, owed, reason, staffID)
+		if err != nil {
+			return err
+		}
+	}
+	if paid > 0 {
+		_, err = tx.Exec(stmt, fineID, EntryRefund, paid, reason, staffID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// daysLate counts the days the library was open after the due date, up to
+// and including the day the book came back. Closed days aren't charged.
+func daysLate(q querier, dueDate, returnedAt time.Time) (int, error) {
+	if !dateOf(returnedAt).After(dateOf(dueDate)) {
+		return 0, nil
+	}
+	c, err := loadCalendar(q, dueDate)
+	if err != nil {
+		return 0, err
+	}
+	return c.openDaysBetween(dueDate, returnedAt), nil
+}
+
+const fineSelect = `SELECT f.id, f.user_id, f.issue_id, COALESCE(b.title, ''), u.name, f.kind, f.days_late, f.amount,
+             COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind = 'payment'), 0) AS paid,
+             COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind = 'waiver'), 0) AS waived,
+             COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind = 'refund'), 0) AS refunded,
+             f.created
+             FROM fines f
+             JOIN users u ON u.id = f.user_id
+             LEFT JOIN issues i ON i.id = f.issue_id
+             LEFT JOIN books b ON b.id = i.book_id`
+
+func fineFields(f *Fine) []any {
+	return []any{
+		&f.ID, &f.UserID, &f.IssueID, &f.BookTitle, &f.UserName, &f.Kind, &f.DaysLate, &f.Amount,
+		&f.Paid, &f.Waived, &f.Refunded, &f.Created,
+	}
+}
+
+func scanFines(rows *sql.Rows) ([]*Fine, error) {
+	var fines []*Fine
+	for rows.Next() {
+		f := &Fine{}
+		err := rows.Scan(fineFields(f)...)
+		if err != nil {
+			return nil, err
+		}
+		fines = append(fines, f)
+	}
+	return fines, rows.Err()
+}
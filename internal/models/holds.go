@@ -0,0 +1,354 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type HoldModelInterface interface {
+	Place(bookID, userID int) (int, error)
+	Cancel(holdID, userID int) error
+	CancelByStaff(holdID int) error
+	GetByUser(userID int) ([]*Hold, error)
+	GetActive() ([]*Hold, error)
+	ExpireReady() (int, error)
+}
+
+// Hold statuses. A hold waits in the queue until a returned copy is set aside
+// for it (ready), and is closed as fulfilled, cancelled or expired.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+type Hold struct {
+	ID        int
+	BookID    int
+	UserID    int
+	BookTitle string
+	UserName  string
+	Status    string
+	Position  int
+	Created   time.Time
+	ReadyAt   *time.Time
+	ExpiresAt *time.Time
+}
+
+type HoldModel struct {
+	DB *sql.DB
+	// PickupDays is how long a copy stays set aside for a ready hold.
+	PickupDays int
+}
+
+// Place puts the user in the queue for a book. Holds are only accepted while
+// every copy is out; otherwise the user should just issue the book. Suspended
+// patrons and those whose membership has expired can't place holds.
+func (m *HoldModel) Place(bookID, userID int) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = lockLendableBook(tx, bookID)
+	if err != nil {
+		return 0, err
+	}
+	err = accountBlock(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	var available int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM book_copies WHERE book_id = ? AND status = 'available'`, bookID).Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+	if available > 0 {
+		return 0, ErrCopiesAvailable
+	}
+
+	var issued, held bool
+	err = tx.QueryRow(
+		`SELECT EXISTS(SELECT true FROM issues WHERE book_id = ? AND user_id = ? AND returned_at IS NULL),
+                EXISTS(SELECT true FROM holds WHERE book_id = ? AND user_id = ? AND status IN ('waiting', 'ready'))`,
+		bookID, userID, bookID, userID,
+	).Scan(&issued, &held)
+	if err != nil {
+		return 0, err
+	}
+	if issued {
+		return 0, ErrAlreadyIssued
+	}
+	if held {
+		return 0, ErrAlreadyOnHold
+	}
+
+	result, err := tx.Exec(`INSERT INTO holds (book_id, user_id, status, created) VALUES (?, ?, 'waiting', NOW())`, bookID, userID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// Cancel cancels one of the user's own waiting or ready holds.
+func (m *HoldModel) Cancel(holdID, userID int) error {
+	return m.cancel(holdID, userID)
+}
+
+// CancelByStaff cancels any waiting or ready hold.
+func (m *HoldModel) CancelByStaff(holdID int) error {
+	return m.cancel(holdID, 0)
+}
+
+// cancel closes the hold and, if a copy was already set aside for it, passes
+// that copy on to the next patron in the queue. userID 0 skips the owner check.
+func (m *HoldModel) cancel(holdID, userID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bookID, ownerID int
+	err = tx.QueryRow(`SELECT book_id, user_id FROM holds WHERE id = ?`, holdID).Scan(&bookID, &ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if userID != 0 && ownerID != userID {
+		return ErrNoRecord
+	}
+
+	status, copyID, err := lockHold(tx, bookID, holdID)
+	if err != nil {
+		return err
+	}
+	if status != HoldWaiting && status != HoldReady {
+		return ErrNoRecord
+	}
+
+	_, err = tx.Exec(`UPDATE holds SET status = 'cancelled', closed_at = NOW() WHERE id = ?`, holdID)
+	if err != nil {
+		return err
+	}
+	if status == HoldReady {
+		err = releaseCopy(tx, copyID, m.PickupDays)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *HoldModel) GetByUser(userID int) ([]*Hold, error) {
+	stmt := holdSelect + ` WHERE h.user_id = ? AND h.status IN ('waiting', 'ready') ORDER BY h.created`
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHolds(rows)
+}
+
+func (m *HoldModel) GetActive() ([]*Hold, error) {
+	stmt := holdSelect + ` WHERE h.status IN ('waiting', 'ready') ORDER BY b.title, h.created`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanHolds(rows)
+}
+
+// ExpireReady expires ready holds whose pickup window has passed and hands
+// each copy to the next hold in line. It returns how many holds expired.
+func (m *HoldModel) ExpireReady() (int, error) {
+	type overdueHold struct{ id, bookID int }
+
+	rows, err := m.DB.Query(`SELECT id, book_id FROM holds WHERE status = 'ready' AND expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	var overdue []overdueHold
+	for rows.Next() {
+		var h overdueHold
+		err = rows.Scan(&h.id, &h.bookID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		overdue = append(overdue, h)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, h := range overdue {
+		ok, err := m.expire(h.id, h.bookID)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (m *HoldModel) expire(holdID, bookID int) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	status, copyID, err := lockHold(tx, bookID, holdID)
+	if err != nil {
+		return false, err
+	}
+	// picked up or cancelled since we looked
+	if status != HoldReady {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`UPDATE holds SET status = 'expired', closed_at = NOW() WHERE id = ?`, holdID)
+	if err != nil {
+		return false, err
+	}
+	err = releaseCopy(tx, copyID, m.PickupDays)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// lockHold locks the book row and then the hold row, always in that order so
+// it can't deadlock with Issue, and returns the hold's current status and the
+// copy set aside for it (0 unless the hold is ready).
+func lockHold(tx *sql.Tx, bookID, holdID int) (string, int, error) {
+	err := lockBook(tx, bookID)
+	if err != nil {
+		return "", 0, err
+	}
+	var status string
+	var copyID int
+	err = tx.QueryRow(`SELECT status, COALESCE(copy_id, 0) FROM holds WHERE id = ? FOR UPDATE`, holdID).Scan(&status, &copyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", 0, ErrNoRecord
+		}
+		return "", 0, err
+	}
+	return status, copyID, nil
+}
+
+func lockBook(tx *sql.Tx, bookID int) error {
+	var id int
+	err := tx.QueryRow(`SELECT id FROM books WHERE id = ? FOR UPDATE`, bookID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoRecord
+	}
+	return err
+}
+
+// lockLendableBook is lockBook for new loans and holds, which withdrawn books
+// refuse with ErrBookWithdrawn and reference items with ErrNotLoanable.
+func lockLendableBook(tx *sql.Tx, bookID int) error {
+	var withdrawn bool
+	var itemTypeID int
+	err := tx.QueryRow(`SELECT withdrawn_at IS NOT NULL, item_type_id FROM books WHERE id = ? FOR UPDATE`, bookID).Scan(&withdrawn, &itemTypeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoRecord
+	}
+	if err != nil {
+		return err
+	}
+	if withdrawn {
+		return ErrBookWithdrawn
+	}
+
+	var loanable bool
+	err = tx.QueryRow(`SELECT loanable FROM item_types WHERE id = ?`, itemTypeID).Scan(&loanable)
+	if err != nil {
+		return err
+	}
+	if !loanable {
+		return ErrNotLoanable
+	}
+	return nil
+}
+
+// releaseCopy handles a copy coming back into circulation: it is set aside
+// for the oldest waiting hold on its book if there is one, otherwise it goes
+// back on the shelf and the book's subscribers are told.
+func releaseCopy(tx *sql.Tx, copyID, pickupDays int) error {
+	var bookID int
+	err := tx.QueryRow(`SELECT book_id FROM book_copies WHERE id = ?`, copyID).Scan(&bookID)
+	if err != nil {
+		return err
+	}
+	err = lockBook(tx, bookID)
+	if err != nil {
+		return err
+	}
+
+	var holdID int
+	err = tx.QueryRow(
+		`SELECT id FROM holds WHERE book_id = ? AND status = 'waiting' ORDER BY created, id LIMIT 1 FOR UPDATE`,
+		bookID,
+	).Scan(&holdID)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.Exec(`UPDATE book_copies SET status = 'available' WHERE id = ?`, copyID)
+		if err != nil {
+			return err
+		}
+		return notifySubscribers(tx, bookID)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE holds SET status = 'ready', copy_id = ?, ready_at = NOW(), expires_at = DATE_ADD(NOW(), INTERVAL ? DAY) WHERE id = ?`,
+		copyID, pickupDays, holdID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE book_copies SET status = 'on_hold' WHERE id = ?`, copyID)
+	return err
+}
+
+const holdSelect = `SELECT h.id, h.book_id, h.user_id, b.title, u.name, h.status,
+             (SELECT COUNT(*) FROM holds q WHERE q.book_id = h.book_id AND q.status = 'waiting'
+                 AND (q.created < h.created OR (q.created = h.created AND q.id <= h.id))),
+             h.created, h.ready_at, h.expires_at
+             FROM holds h
+             JOIN books b ON b.id = h.book_id
+             JOIN users u ON u.id = h.user_id`
+
+func scanHolds(rows *sql.Rows) ([]*Hold, error) {
+	var holds []*Hold
+	for rows.Next() {
+		h := &Hold{}
+		err := rows.Scan(&h.ID, &h.BookID, &h.UserID, &h.BookTitle, &h.UserName, &h.Status,
+			&h.Position, &h.Created, &h.ReadyAt, &h.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
@@ -3,68 +3,676 @@ package models
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
 type IssueModelInterface interface {
-	Issue(bookID, userID int, dueDate time.Time) (int, error)
+	Issue(bookID, userID, staffID, branchID int) (int, time.Time, error)
+	IssueCopy(copyID, userID, staffID, branchID int) (int, time.Time, error)
+	KioskIssueCopy(copyID, userID, kioskID int) (int, time.Time, error)
 	Return(issueID, userID int) error
+	KioskReturn(issueID, userID, kioskID int) error
+	CheckIn(issueID, staffID, branchID int, returnedAt time.Time, note string) error
+	DeclareLoss(issueID, staffID int, loss, note string) (int, error)
+	ReverseLoss(issueID, staffID int) error
+	Recall(issueID, staffID int, requestedBy string) (time.Time, error)
+	Renew(issueID, userID int) (time.Time, error)
+	Get(id int) (*Issue, error)
 	GetActiveByUser(userID int) ([]*Issue, error)
 	GetActiveByBook(bookID int) ([]*Issue, error)
-	GetAll() ([]*Issue, error)
+	GetAll(branchIDs []int) ([]*Issue, error)
+	History(userID int, search string, page, perPage int) ([]*Issue, int, error)
 	GetActiveIssue(bookID, userID int) (*Issue, error)
+	GetActiveByCopy(copyID int) (*Issue, error)
+	Blocks(userID int) ([]error, error)
 }
 
 type Issue struct {
-	ID         int
-	BookID     int
-	UserID     int
-	BookTitle  string
+	ID        int
+	BookID    int
+	UserID    int
+	BookTitle string
+	// Barcode is the copy on loan; empty for loans from before per-copy
+	// tracking.
+	Barcode string
+	// UserName is empty, and UserID 0, once a returned loan has been
+	// anonymised.
 	UserName   string
 	IssuedAt   time.Time
 	DueDate    time.Time
 	ReturnedAt *time.Time
+
+	RenewalCount int
+	MaxRenewals  int
+	// IssuedByName is the staff member who issued the loan at the desk, or
+	// empty when the patron issued it themselves.
+	IssuedByName string
+	// ReturnedByName is the staff member who checked the book in, if any.
+	ReturnedByName string
+	// IssuedKiosk and ReturnedKiosk name the self-service kiosk used, if
+	// any.
+	IssuedKiosk   string
+	ReturnedKiosk string
+	// IssuedBranch and ReturnedBranch name the branch that lent the book
+	// and the one that received it back, if known.
+	IssuedBranch   string
+	ReturnedBranch string
+	// ReserveCourse is the course whose reserve set a short loan period,
+	// e.g. a 4-hour loan, if any.
+	ReserveCourse string
+	ConditionNote string
+	// Loss is LossLost or LossDamaged when the loan was closed by declaring
+	// the copy lost or damaged, otherwise empty.
+	Loss string
+	// RecalledAt is set when staff recalled the book; RecallRequestedBy is
+	// who asked for it and RecalledByName the staff member who recalled it.
+	RecalledAt        *time.Time
+	RecallRequestedBy string
+	RecalledByName    string
+}
+
+// Ways a loan can end other than a normal return.
+const (
+	LossLost    = "lost"
+	LossDamaged = "damaged"
+)
+
+// Overdue reports whether the loan is still out past its due date.
+func (i *Issue) Overdue() bool {
+	return i.ReturnedAt == nil && time.Now().After(i.DueDate)
+}
+
+// RenewalsLeft reports how many more times the loan can be renewed.
+func (i *Issue) RenewalsLeft() int {
+	if i.RenewalCount >= i.MaxRenewals {
+		return 0
+	}
+	return i.MaxRenewals - i.RenewalCount
 }
 
 type IssueModel struct {
 	DB *sql.DB
+	// HoldPickupDays is how long a returned copy is kept for the next hold.
+	HoldPickupDays int
+	Fines          FineRules
+}
+
+// Issue lends a copy of the book to the user: the copy set aside for their
+// ready hold if they have one, otherwise any copy on the shelf. The book row
+// is locked for the length of the transaction so concurrent requests cannot
+// both take the last copy, and the issue is only written if the copy can be
+// marked on loan. The loan period and limits come from the loan policy for
+// the user's role, and a due date on a closed day moves to the next open day.
+// Books on a current course reserve get the reserve's short loan instead.
+// The policy's renewal limit is stored on the loan so later policy changes
+// don't affect it. Withdrawn books can't be issued. staffID records who
+// issued the book at the desk; pass 0 when patrons issue books to
+// themselves. branchID is the branch issuing the book, and only its copies
+// are lent; with 0, copies at the user's default branch are preferred. It
+// returns the new issue's ID and due date.
+func (m *IssueModel) Issue(bookID, userID, staffID, branchID int) (int, time.Time, error) {
+	return m.issue(bookID, 0, userID, staffID, 0, branchID)
 }
 
-func (m *IssueModel) Issue(bookID, userID int, dueDate time.Time) (int, error) {
-	stmt := `INSERT INTO issues (book_id, user_id, issued_at, due_date) VALUES (?, ?, NOW(), ?)`
-	result, err := m.DB.Exec(stmt, bookID, userID, dueDate)
+// IssueCopy is Issue for a specific copy, e.g. one scanned at the desk. It
+// fails with ErrCopyUnavailable unless the copy is on the shelf or held for
+// this user, and with ErrWrongBranch if branchID is set and the copy belongs
+// to another branch.
+func (m *IssueModel) IssueCopy(copyID, userID, staffID, branchID int) (int, time.Time, error) {
+	return m.issueCopy(copyID, userID, staffID, 0, branchID)
+}
+
+// KioskIssueCopy is IssueCopy for a patron serving themselves at a kiosk;
+// the loan records the kiosk.
+func (m *IssueModel) KioskIssueCopy(copyID, userID, kioskID int) (int, time.Time, error) {
+	return m.issueCopy(copyID, userID, 0, kioskID, 0)
+}
+
+func (m *IssueModel) issueCopy(copyID, userID, staffID, kioskID, branchID int) (int, time.Time, error) {
+	var bookID int
+	err := m.DB.QueryRow(`SELECT book_id FROM book_copies WHERE id = ?`, copyID).Scan(&bookID)
 	if err != nil {
-		return 0, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, ErrNoRecord
+		}
+		return 0, time.Time{}, err
+	}
+	return m.issue(bookID, copyID, userID, staffID, kioskID, branchID)
+}
+
+func (m *IssueModel) issue(bookID, copyID, userID, staffID, kioskID, branchID int) (int, time.Time, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	// staff can only lend from a branch they are working at
+	if staffID != 0 && branchID == 0 {
+		return 0, time.Time{}, ErrNoBranch
+	}
+	err = lockLendableBook(tx, bookID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var issued bool
+	err = tx.QueryRow(
+		`SELECT EXISTS(SELECT true FROM issues WHERE book_id = ? AND user_id = ? AND returned_at IS NULL)`,
+		bookID, userID,
+	).Scan(&issued)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if issued {
+		return 0, time.Time{}, ErrAlreadyIssued
+	}
+
+	// lock the user so two issues of different books can't both squeeze
+	// under the loan limit
+	err = lockUser(tx, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	blocks, policy, err := m.borrowingBlocks(tx, userID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(blocks) > 0 {
+		return 0, time.Time{}, blocks[0]
+	}
+
+	var holdID, heldCopyID int
+	err = tx.QueryRow(
+		`SELECT id, COALESCE(copy_id, 0) FROM holds WHERE book_id = ? AND user_id = ? AND status = 'ready' FOR UPDATE`,
+		bookID, userID,
+	).Scan(&holdID, &heldCopyID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, err
+	}
+
+	switch {
+	case copyID == 0 && heldCopyID != 0:
+		// the held copy waits on its branch's hold shelf, so only that
+		// branch can lend it
+		var heldBranchID int
+		err = tx.QueryRow(`SELECT branch_id FROM book_copies WHERE id = ? FOR UPDATE`, heldCopyID).Scan(&heldBranchID)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if branchID != 0 && heldBranchID != branchID {
+			return 0, time.Time{}, ErrWrongBranch
+		}
+		copyID = heldCopyID
+	case copyID == 0 && branchID != 0:
+		err = tx.QueryRow(
+			`SELECT id FROM book_copies WHERE book_id = ? AND branch_id = ? AND status = 'available' ORDER BY id LIMIT 1 FOR UPDATE`,
+			bookID, branchID,
+		).Scan(&copyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, ErrNoCopiesAvailable
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+	case copyID == 0:
+		err = tx.QueryRow(
+			`SELECT id FROM book_copies WHERE book_id = ? AND status = 'available'
+             ORDER BY branch_id <=> (SELECT default_branch_id FROM users WHERE id = ?) DESC, id LIMIT 1 FOR UPDATE`,
+			bookID, userID,
+		).Scan(&copyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, ErrNoCopiesAvailable
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+	default:
+		var status string
+		var copyBranchID int
+		err = tx.QueryRow(`SELECT status, branch_id FROM book_copies WHERE id = ? FOR UPDATE`, copyID).Scan(&status, &copyBranchID)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if branchID != 0 && copyBranchID != branchID {
+			return 0, time.Time{}, ErrWrongBranch
+		}
+		if status != CopyAvailable && !(status == CopyOnHold && copyID == heldCopyID) {
+			return 0, time.Time{}, ErrCopyUnavailable
+		}
+	}
+
+	dueDate, reserveID, err := loanDueDate(tx, bookID, time.Now(), policy)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	stmt := `INSERT INTO issues (book_id, copy_id, user_id, issued_at, due_date, max_renewals, issued_by, issued_kiosk_id, issued_branch_id, reserve_id)
+             VALUES (?, ?, ?, NOW(), ?, ?, ?, ?, COALESCE(?, (SELECT branch_id FROM book_copies WHERE id = ?)), ?)`
+	result, err := tx.Exec(stmt, bookID, copyID, userID, dueDate, policy.MaxRenewals, nullableID(staffID), nullableID(kioskID),
+		nullableID(branchID), copyID, nullableID(reserveID))
+	if err != nil {
+		return 0, time.Time{}, err
 	}
 	id, err := result.LastInsertId()
-	return int(id), err
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE book_copies SET status = 'on_loan' WHERE id = ?`, copyID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if holdID != 0 {
+		_, err = tx.Exec(`UPDATE holds SET status = 'fulfilled', closed_at = NOW() WHERE id = ?`, holdID)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		// the patron took a different copy from the one held for them, so
+		// pass the held one on
+		if heldCopyID != 0 && heldCopyID != copyID {
+			err = releaseCopy(tx, heldCopyID, m.HoldPickupDays)
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+		}
+	}
+
+	return int(id), dueDate, tx.Commit()
 }
 
+// Return closes the user's own active issue. ErrNoRecord means the issue
+// does not belong to the user or has already been returned.
 func (m *IssueModel) Return(issueID, userID int) error {
-	result, err := m.DB.Exec(
-		`UPDATE issues SET returned_at = NOW() WHERE id = ? AND user_id = ? AND returned_at IS NULL`,
-		issueID, userID,
+	return m.close(issueID, userID, 0, 0, 0, time.Now(), "")
+}
+
+// KioskReturn is Return at a self-service kiosk; the loan records the kiosk
+// and the kiosk's branch.
+func (m *IssueModel) KioskReturn(issueID, userID, kioskID int) error {
+	var branchID int
+	err := m.DB.QueryRow(`SELECT branch_id FROM kiosk_devices WHERE id = ?`, kioskID).Scan(&branchID)
+	if err != nil {
+		return err
+	}
+	return m.close(issueID, userID, 0, kioskID, branchID, time.Now(), "")
+}
+
+// CheckIn lets a staff member return any active issue, e.g. a book dropped
+// off at the desk of branchID. returnedAt is when the book actually came
+// back, which may be earlier than now, and note records its condition.
+func (m *IssueModel) CheckIn(issueID, staffID, branchID int, returnedAt time.Time, note string) error {
+	return m.close(issueID, 0, staffID, 0, branchID, returnedAt, note)
+}
+
+// close returns an issue and, in the same transaction, charges any overdue
+// fine and either sets the copy aside for the next hold, puts it back on the
+// shelf, or sends it home if it came back to another branch. ownerID 0 skips
+// the owner check; staffID 0 means self-service, at the kiosk kioskID if
+// that isn't 0. branchID is where the book came back, 0 if unknown.
+func (m *IssueModel) close(issueID, ownerID, staffID, kioskID, branchID int, returnedAt time.Time, note string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var copyID, userID int
+	var issuedAt, dueDate time.Time
+	err = tx.QueryRow(
+		`SELECT COALESCE(copy_id, 0), user_id, issued_at, due_date FROM issues WHERE id = ? AND returned_at IS NULL FOR UPDATE`,
+		issueID,
+	).Scan(&copyID, &userID, &issuedAt, &dueDate)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	if ownerID != 0 && ownerID != userID {
+		return ErrNoRecord
+	}
+	if returnedAt.Before(issuedAt) || returnedAt.After(time.Now()) {
+		return ErrInvalidReturnTime
+	}
+
+	_, err = tx.Exec(
+		`UPDATE issues SET returned_at = ?, returned_by = ?, returned_kiosk_id = ?, returned_branch_id = ?, condition_note = ? WHERE id = ?`,
+		returnedAt, nullableID(staffID), nullableID(kioskID), nullableID(branchID), note, issueID,
+	)
+	if err != nil {
+		return err
+	}
+	err = chargeOverdue(tx, m.Fines, issueID, userID, dueDate, returnedAt)
+	if err != nil {
+		return err
+	}
+	err = forgetHistory(tx, userID)
+	if err != nil {
+		return err
+	}
+	err = liftOverdueSuspension(tx, userID, staffID)
+	if err != nil {
+		return err
+	}
+	// loans from before per-copy tracking have no copy to put back
+	if copyID != 0 {
+		err = shelveReturnedCopy(tx, copyID, branchID, staffID, m.HoldPickupDays)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeclareLoss closes an active loan whose copy is lost, or came back too
+// damaged to lend, and takes the copy out of circulation. loss is LossLost or
+// LossDamaged. The patron is charged the copy's replacement cost (the book's
+// if the copy has none) on top of any overdue fine so far. It returns the
+// replacement charge in cents.
+func (m *IssueModel) DeclareLoss(issueID, staffID int, loss, note string) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cost, err := m.declareLoss(tx, issueID, staffID, loss, note)
+	if err != nil {
+		return 0, err
+	}
+	return cost, tx.Commit()
+}
+
+// declareLoss is DeclareLoss within tx, so that the overdue processor can
+// close a loan as lost in the same transaction as its final notice.
+func (m *IssueModel) declareLoss(tx *sql.Tx, issueID, staffID int, loss, note string) (int, error) {
+	var bookID int
+	err := tx.QueryRow(`SELECT book_id FROM issues WHERE id = ?`, issueID).Scan(&bookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	err = lockBook(tx, bookID)
+	if err != nil {
+		return 0, err
+	}
+
+	var copyID, userID, cost int
+	var dueDate time.Time
+	err = tx.QueryRow(
+		`SELECT COALESCE(i.copy_id, 0), i.user_id, i.due_date, COALESCE(c.replacement_cost, b.replacement_cost)
+         FROM issues i
+         JOIN books b ON b.id = i.book_id
+         LEFT JOIN book_copies c ON c.id = i.copy_id
+         WHERE i.id = ? AND i.returned_at IS NULL FOR UPDATE`,
+		issueID,
+	).Scan(&copyID, &userID, &dueDate, &cost)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		`UPDATE issues SET returned_at = ?, returned_by = ?, condition_note = ?, loss = ? WHERE id = ?`,
+		now, nullableID(staffID), note, loss, issueID,
 	)
+	if err != nil {
+		return 0, err
+	}
+	err = chargeOverdue(tx, m.Fines, issueID, userID, dueDate, now)
+	if err != nil {
+		return 0, err
+	}
+	err = chargeReplacement(tx, issueID, userID, cost)
+	if err != nil {
+		return 0, err
+	}
+	err = forgetHistory(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	err = liftOverdueSuspension(tx, userID, staffID)
+	if err != nil {
+		return 0, err
+	}
+	if copyID != 0 {
+		_, err = tx.Exec(`UPDATE book_copies SET status = ? WHERE id = ?`, loss, copyID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return cost, nil
+}
+
+// ReverseLoss undoes DeclareLoss for a lost copy that has turned up: the
+// replacement charge is waived, or refunded if it was paid, and the copy goes
+// back into circulation. It fails with ErrNotLost unless the loan was closed
+// as lost and its copy is still marked lost.
+func (m *IssueModel) ReverseLoss(issueID, staffID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bookID int
+	err = tx.QueryRow(`SELECT book_id FROM issues WHERE id = ?`, issueID).Scan(&bookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRecord
+		}
+		return err
+	}
+	err = lockBook(tx, bookID)
+	if err != nil {
+		return err
+	}
+
+	var copyID int
+	var loss, copyStatus string
+	err = tx.QueryRow(
+		`SELECT COALESCE(i.copy_id, 0), COALESCE(i.loss, ''), COALESCE(c.status, 'lost')
+         FROM issues i
+         LEFT JOIN book_copies c ON c.id = i.copy_id
+         WHERE i.id = ? FOR UPDATE`,
+		issueID,
+	).Scan(&copyID, &loss, &copyStatus)
+	if err != nil {
+		return err
+	}
+	if loss != LossLost || copyStatus != CopyLost {
+		return ErrNotLost
+	}
+
+	_, err = tx.Exec(`UPDATE issues SET loss = NULL WHERE id = ?`, issueID)
 	if err != nil {
 		return err
 	}
-	rows, err := result.RowsAffected()
+	err = reverseReplacement(tx, issueID, staffID, "Lost item found")
 	if err != nil {
 		return err
 	}
-	if rows == 0 {
-		return errors.New("issue not found or already returned")
+	if copyID != 0 {
+		err = releaseCopy(tx, copyID, m.HoldPickupDays)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Recall asks for an active loan back early on behalf of requestedBy. The due
+// date is brought forward to the end of the borrower's guaranteed loan period
+// (their policy's RecallMinDays from issue), or tomorrow if that has already
+// passed, then rolled forward past closed days; it is never pushed later. The
+// loan can't be renewed afterwards and the borrower is notified. It returns
+// the new due date.
+func (m *IssueModel) Recall(issueID, staffID int, requestedBy string) (time.Time, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var title string
+	var issuedAt, dueDate time.Time
+	var recalled bool
+	err = tx.QueryRow(
+		`SELECT i.user_id, b.title, i.issued_at, i.due_date, i.recalled_at IS NOT NULL
+         FROM issues i JOIN books b ON b.id = i.book_id
+         WHERE i.id = ? AND i.returned_at IS NULL FOR UPDATE`,
+		issueID,
+	).Scan(&userID, &title, &issuedAt, &dueDate, &recalled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, ErrNoRecord
+		}
+		return time.Time{}, err
+	}
+	if recalled {
+		return time.Time{}, ErrAlreadyRecalled
+	}
+
+	policy, err := policyForUser(tx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	from, days := issuedAt, policy.RecallMinDays
+	if tomorrow := time.Now().AddDate(0, 0, 1); issuedAt.AddDate(0, 0, days).Before(tomorrow) {
+		from, days = tomorrow, 0
+	}
+	newDueDate, err := dueDateFrom(tx, from, days)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if newDueDate.After(dueDate) {
+		newDueDate = dueDate
+	}
+
+	_, err = tx.Exec(
+		`UPDATE issues SET due_date = ?, recalled_at = NOW(), recalled_by = ?, recall_requested_by = ? WHERE id = ?`,
+		newDueDate, staffID, requestedBy, issueID,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = notifyLoan(tx, userID, issueID, fmt.Sprintf("%q has been recalled because another reader needs it. Please return it by %s. It can no longer be renewed.",
+		title, newDueDate.Format("02 Jan 2006")))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return newDueDate, tx.Commit()
+}
+
+// Renew extends the user's active loan by the loan period from their policy,
+// or the short loan of a course reserve the book is on, counted from now and
+// rolled forward past closed days, and records the renewal. It refuses once
+// the renewal limit is used up, when the loan is further overdue than the
+// policy's grace days, when the book has been recalled, when the patron is
+// suspended or their membership has expired, or when another patron has a
+// hold waiting on the book.
+func (m *IssueModel) Renew(issueID, userID int) (time.Time, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var bookID int
+	var dueDate time.Time
+	var renewalCount, maxRenewals int
+	var recalled bool
+	err = tx.QueryRow(
+		`SELECT book_id, due_date, renewal_count, max_renewals, recalled_at IS NOT NULL FROM issues
+         WHERE id = ? AND user_id = ? AND returned_at IS NULL FOR UPDATE`,
+		issueID, userID,
+	).Scan(&bookID, &dueDate, &renewalCount, &maxRenewals, &recalled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, ErrNoRecord
+		}
+		return time.Time{}, err
+	}
+
+	if recalled {
+		return time.Time{}, ErrRecalled
+	}
+	err = accountBlock(tx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if renewalCount >= maxRenewals {
+		return time.Time{}, ErrRenewalLimitReached
+	}
+	policy, err := policyForUser(tx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	if now.After(dueDate.AddDate(0, 0, policy.GraceDays)) {
+		return time.Time{}, ErrRenewalOverdue
+	}
+
+	var waiting bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT true FROM holds WHERE book_id = ? AND status = 'waiting')`, bookID).Scan(&waiting)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if waiting {
+		return time.Time{}, ErrHoldsPending
+	}
+
+	newDueDate, reserveID, err := loanDueDate(tx, bookID, now, policy)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if newDueDate.Before(dueDate) {
+		newDueDate = dueDate
+	}
+
+	_, err = tx.Exec(
+		`UPDATE issues SET due_date = ?, renewal_count = renewal_count + 1, reserve_id = ? WHERE id = ?`,
+		newDueDate, nullableID(reserveID), issueID,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO issue_renewals (issue_id, renewed_at, previous_due_date, new_due_date) VALUES (?, NOW(), ?, ?)`,
+		issueID, dueDate, newDueDate,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return newDueDate, tx.Commit()
+}
+
+func (m *IssueModel) Get(id int) (*Issue, error) {
+	issue := &Issue{}
+	err := m.DB.QueryRow(issueSelect+` WHERE i.id = ?`, id).Scan(issueFields(issue)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
 	}
-	return nil
+	return issue, nil
 }
 
 func (m *IssueModel) GetActiveByUser(userID int) ([]*Issue, error) {
-	stmt := `SELECT i.id, i.book_id, i.user_id, b.title, u.name, i.issued_at, i.due_date, i.returned_at
-             FROM issues i
-             JOIN books b ON b.id = i.book_id
-             JOIN users u ON u.id = i.user_id
-             WHERE i.user_id = ? AND i.returned_at IS NULL
-             ORDER BY i.issued_at DESC`
+	stmt := issueSelect + ` WHERE i.user_id = ? AND i.returned_at IS NULL ORDER BY i.issued_at DESC`
 	rows, err := m.DB.Query(stmt, userID)
 	if err != nil {
 		return nil, err
@@ -74,11 +682,7 @@ func (m *IssueModel) GetActiveByUser(userID int) ([]*Issue, error) {
 }
 
 func (m *IssueModel) GetActiveByBook(bookID int) ([]*Issue, error) {
-	stmt := `SELECT i.id, i.book_id, i.user_id, b.title, u.name, i.issued_at, i.due_date, i.returned_at
-             FROM issues i
-             JOIN books b ON b.id = i.book_id
-             JOIN users u ON u.id = i.user_id
-             WHERE i.book_id = ? AND i.returned_at IS NULL`
+	stmt := issueSelect + ` WHERE i.book_id = ? AND i.returned_at IS NULL`
 	rows, err := m.DB.Query(stmt, bookID)
 	if err != nil {
 		return nil, err
@@ -87,13 +691,23 @@ func (m *IssueModel) GetActiveByBook(bookID int) ([]*Issue, error) {
 	return scanIssues(rows)
 }
 
-func (m *IssueModel) GetAll() ([]*Issue, error) {
-	stmt := `SELECT i.id, i.book_id, i.user_id, b.title, u.name, i.issued_at, i.due_date, i.returned_at
-             FROM issues i
-             JOIN books b ON b.id = i.book_id
-             JOIN users u ON u.id = i.user_id
-             ORDER BY i.issued_at DESC`
-	rows, err := m.DB.Query(stmt)
+// GetAll returns every loan, newest first. A non-nil branchIDs limits it to
+// loans issued at those branches or of copies that belong to them.
+func (m *IssueModel) GetAll(branchIDs []int) ([]*Issue, error) {
+	stmt := issueSelect
+	var args []any
+	if branchIDs != nil {
+		if len(branchIDs) == 0 {
+			return nil, nil
+		}
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(branchIDs)), ", ")
+		stmt += ` WHERE i.issued_branch_id IN (` + in + `) OR c.branch_id IN (` + in + `)`
+		for _, id := range branchIDs {
+			args = append(args, id)
+		}
+		args = append(args, args...)
+	}
+	rows, err := m.DB.Query(stmt+` ORDER BY i.issued_at DESC`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -101,17 +715,50 @@ func (m *IssueModel) GetAll() ([]*Issue, error) {
 	return scanIssues(rows)
 }
 
+// History returns one page of the user's returned loans, most recently
+// returned first, along with how many there are in all. search, if given,
+// matches the title, author or ISBN. Pages count from 1.
+func (m *IssueModel) History(userID int, search string, page, perPage int) ([]*Issue, int, error) {
+	where := ` WHERE i.user_id = ? AND i.returned_at IS NOT NULL`
+	args := []any{userID}
+	if search != "" {
+		like := "%" + search + "%"
+		where += ` AND (b.title LIKE ? OR b.author LIKE ? OR b.isbn LIKE ?)`
+		args = append(args, like, like, like)
+	}
+
+	var total int
+	err := m.DB.QueryRow(`SELECT COUNT(*) FROM issues i JOIN books b ON b.id = i.book_id`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt := issueSelect + where + ` ORDER BY i.returned_at DESC, i.id DESC LIMIT ? OFFSET ?`
+	rows, err := m.DB.Query(stmt, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	issues, err := scanIssues(rows)
+	return issues, total, err
+}
+
 func (m *IssueModel) GetActiveIssue(bookID, userID int) (*Issue, error) {
 	issue := &Issue{}
-	stmt := `SELECT i.id, i.book_id, i.user_id, b.title, u.name, i.issued_at, i.due_date, i.returned_at
-             FROM issues i
-             JOIN books b ON b.id = i.book_id
-             JOIN users u ON u.id = i.user_id
-             WHERE i.book_id = ? AND i.user_id = ? AND i.returned_at IS NULL`
-	err := m.DB.QueryRow(stmt, bookID, userID).Scan(
-		&issue.ID, &issue.BookID, &issue.UserID, &issue.BookTitle, &issue.UserName,
-		&issue.IssuedAt, &issue.DueDate, &issue.ReturnedAt,
-	)
+	stmt := issueSelect + ` WHERE i.book_id = ? AND i.user_id = ? AND i.returned_at IS NULL`
+	err := m.DB.QueryRow(stmt, bookID, userID).Scan(issueFields(issue)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return issue, nil
+}
+
+func (m *IssueModel) GetActiveByCopy(copyID int) (*Issue, error) {
+	issue := &Issue{}
+	err := m.DB.QueryRow(issueSelect+` WHERE i.copy_id = ? AND i.returned_at IS NULL`, copyID).Scan(issueFields(issue)...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -121,11 +768,141 @@ func (m *IssueModel) GetActiveIssue(bookID, userID int) (*Issue, error) {
 	return issue, nil
 }
 
+// Blocks returns every reason the user can't borrow another book right now,
+// as the same sentinel errors Issue would return.
+func (m *IssueModel) Blocks(userID int) ([]error, error) {
+	blocks, _, err := m.borrowingBlocks(m.DB, userID)
+	return blocks, err
+}
+
+func (m *IssueModel) borrowingBlocks(q querier, userID int) ([]error, *LoanPolicy, error) {
+	policy, err := policyForUser(q, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var blocks []error
+	blocked, err := suspended(q, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blocked {
+		blocks = append(blocks, ErrBorrowingSuspended)
+	}
+	expired, err := membershipExpired(q, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expired {
+		blocks = append(blocks, ErrMembershipExpired)
+	}
+
+	balance, err := outstandingBalance(q, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if balance > m.Fines.BlockThreshold {
+		blocks = append(blocks, ErrFinesOutstanding)
+	}
+
+	var loans int
+	err = q.QueryRow(`SELECT COUNT(*) FROM issues WHERE user_id = ? AND returned_at IS NULL`, userID).Scan(&loans)
+	if err != nil {
+		return nil, nil, err
+	}
+	if loans >= policy.MaxLoans {
+		blocks = append(blocks, ErrLoanLimitReached)
+	}
+
+	return blocks, policy, nil
+}
+
+// nullableID stores 0 as NULL for optional foreign keys.
+func nullableID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// forgetHistory anonymises the user's returned loans, and unlinks their
+// settled fines and messages, if they have turned off borrowing history.
+// Loans with fines still owing keep their patron until the fine is settled.
+func forgetHistory(q querier, userID int) error {
+	_, err := q.Exec(
+		`UPDATE issues i JOIN users u ON u.id = i.user_id SET i.user_id = NULL, i.recall_requested_by = ''
+         WHERE i.user_id = ? AND NOT u.keep_history AND i.returned_at IS NOT NULL
+         AND NOT EXISTS (`+unpaidFineSelect+`)`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	return unlinkAnonymised(q, userID)
+}
+
+// unlinkAnonymised removes what still ties the user's anonymised loans to
+// them: their settled fines no longer name the loan, and inbox messages about
+// the loan are deleted. userID 0 does this for every patron.
+func unlinkAnonymised(q querier, userID int) error {
+	_, err := q.Exec(
+		`UPDATE fines f JOIN issues i ON i.id = f.issue_id SET f.issue_id = NULL
+         WHERE i.user_id IS NULL AND (? = 0 OR f.user_id = ?)`,
+		userID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`DELETE n FROM notifications n JOIN issues i ON i.id = n.issue_id
+         WHERE i.user_id IS NULL AND (? = 0 OR n.user_id = ?)`,
+		userID, userID,
+	)
+	return err
+}
+
+// unpaidFineSelect finds fines still owing on the loan i.
+const unpaidFineSelect = `SELECT true FROM fines f WHERE f.issue_id = i.id
+             AND f.amount > COALESCE((SELECT SUM(p.amount) FROM fine_payments p WHERE p.fine_id = f.id AND p.kind <> 'refund'), 0)`
+
+// issueSelect is the shared column list for every issue query; callers append
+// their own WHERE/ORDER BY and scan with issueFields.
+const issueSelect = `SELECT i.id, i.book_id, COALESCE(i.user_id, 0), b.title, COALESCE(u.name, ''), i.issued_at, i.due_date, i.returned_at,
+             i.renewal_count, i.max_renewals, COALESCE(s.name, ''), COALESCE(rs.name, ''), i.condition_note,
+             COALESCE(c.barcode, ''), COALESCE(i.loss, ''),
+             i.recalled_at, i.recall_requested_by, COALESCE(rc.name, ''),
+             COALESCE(ik.name, ''), COALESCE(rk.name, ''), COALESCE(ib.name, ''), COALESCE(rb.name, ''),
+             COALESCE(cr.course_code, '')
+             FROM issues i
+             JOIN books b ON b.id = i.book_id
+             LEFT JOIN book_copies c ON c.id = i.copy_id
+             LEFT JOIN users u ON u.id = i.user_id
+             LEFT JOIN users s ON s.id = i.issued_by
+             LEFT JOIN users rs ON rs.id = i.returned_by
+             LEFT JOIN users rc ON rc.id = i.recalled_by
+             LEFT JOIN kiosk_devices ik ON ik.id = i.issued_kiosk_id
+             LEFT JOIN kiosk_devices rk ON rk.id = i.returned_kiosk_id
+             LEFT JOIN branches ib ON ib.id = i.issued_branch_id
+             LEFT JOIN branches rb ON rb.id = i.returned_branch_id
+             LEFT JOIN course_reserves cr ON cr.id = i.reserve_id`
+
+func issueFields(i *Issue) []any {
+	return []any{
+		&i.ID, &i.BookID, &i.UserID, &i.BookTitle, &i.UserName,
+		&i.IssuedAt, &i.DueDate, &i.ReturnedAt,
+		&i.RenewalCount, &i.MaxRenewals, &i.IssuedByName, &i.ReturnedByName, &i.ConditionNote,
+		&i.Barcode, &i.Loss,
+		&i.RecalledAt, &i.RecallRequestedBy, &i.RecalledByName,
+		&i.IssuedKiosk, &i.ReturnedKiosk, &i.IssuedBranch, &i.ReturnedBranch,
+		&i.ReserveCourse,
+	}
+}
+
 func scanIssues(rows *sql.Rows) ([]*Issue, error) {
 	var issues []*Issue
 	for rows.Next() {
 		i := &Issue{}
-		err := rows.Scan(&i.ID, &i.BookID, &i.UserID, &i.BookTitle, &i.UserName, &i.IssuedAt, &i.DueDate, &i.ReturnedAt)
+		err := rows.Scan(issueFields(i)...)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DefaultItemTypeID is the "Regular" item type seeded by schema.sql.
+const DefaultItemTypeID = 1
+
+type ItemTypeModelInterface interface {
+	Insert(name string, loanable bool, loanDays int) (int, error)
+	List() ([]*ItemType, error)
+	Update(t *ItemType) error
+}
+
+// ItemType classifies books by how they circulate, e.g. regular, reference,
+// short loan or media.
+type ItemType struct {
+	ID   int
+	Name string
+	// Loanable is false for reference items, which can't leave the building.
+	Loanable bool
+	// LoanDays overrides the borrower's loan policy for this type; 0 keeps
+	// the policy's loan period.
+	LoanDays int
+}
+
+type ItemTypeModel struct {
+	DB *sql.DB
+}
+
+func (m *ItemTypeModel) Insert(name string, loanable bool, loanDays int) (int, error) {
+	result, err := m.DB.Exec(`INSERT INTO item_types (name, loanable, loan_days) VALUES (?, ?, ?)`, name, loanable, nullableID(loanDays))
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "item_types_uc_name") {
+				return 0, ErrDuplicateItemType
+			}
+		}
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *ItemTypeModel) List() ([]*ItemType, error) {
+	rows, err := m.DB.Query(`SELECT id, name, loanable, COALESCE(loan_days, 0) FROM item_types ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []*ItemType
+	for rows.Next() {
+		t := &ItemType{}
+		err := rows.Scan(&t.ID, &t.Name, &t.Loanable, &t.LoanDays)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
+
+// Update changes a type's loan rules. Loans already out keep their due dates.
+func (m *ItemTypeModel) Update(t *ItemType) error {
+	result, err := m.DB.Exec(`UPDATE item_types SET loanable = ?, loan_days = ? WHERE id = ?`, t.Loanable, nullableID(t.LoanDays), t.ID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// RowsAffected is 0 when nothing changed too, so double check the row exists
+	if n == 0 {
+		var exists bool
+		err = m.DB.QueryRow(`SELECT EXISTS(SELECT true FROM item_types WHERE id = ?)`, t.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// JobRun records one run of a background job.
+type JobRun struct {
+	ID         int
+	Job        string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	// Processed is how many records the run acted on, e.g. notices sent.
+	Processed int
+	// Failed is how many records the run skipped because acting on them
+	// failed. Failures holds their errors; only the count and the messages,
+	// in Error, are stored.
+	Failed   int
+	Failures []error
+	Error    string
+}
+
+// runJob records a run of job in job_runs around fn, which is passed the
+// run's ID and returns how many records it acted on and the errors for any
+// it had to skip. The run is returned even when fn fails part way.
+func runJob(db *sql.DB, job string, fn func(runID int) (int, []error, error)) (*JobRun, error) {
+	run := &JobRun{Job: job, StartedAt: time.Now()}
+	result, err := db.Exec(`INSERT INTO job_runs (job, started_at) VALUES (?, ?)`, run.Job, run.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	run.ID = int(id)
+
+	run.Processed, run.Failures, err = fn(run.ID)
+	run.Failed = len(run.Failures)
+	var msgs []string
+	for _, f := range run.Failures {
+		msgs = append(msgs, f.Error())
+	}
+	if err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	run.Error = strings.Join(msgs, "; ")
+	if len(run.Error) > 1000 {
+		run.Error = run.Error[:997] + "..."
+	}
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+
+	_, ferr := db.Exec(
+		`UPDATE job_runs SET finished_at = ?, processed = ?, failed = ?, error = ? WHERE id = ?`,
+		finishedAt, run.Processed, run.Failed, run.Error, run.ID,
+	)
+	if err == nil {
+		err = ferr
+	}
+	return run, err
+}
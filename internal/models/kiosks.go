@@ -0,0 +1,129 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+type KioskModelInterface interface {
+	Insert(name string, branchID int) (int, string, error)
+	Authenticate(key string) (*Kiosk, error)
+	List() ([]*Kiosk, error)
+	Revoke(id int) error
+}
+
+// Kiosk is a self-service terminal. It proves who it is with a device key,
+// of which only a hash is stored.
+type Kiosk struct {
+	ID   int
+	Name string
+	// BranchID is the branch the kiosk stands in; returns made at it are
+	// received by that branch.
+	BranchID   int
+	BranchName string
+	Created    time.Time
+	LastSeen   *time.Time
+	RevokedAt  *time.Time
+}
+
+type KioskModel struct {
+	DB *sql.DB
+}
+
+// Insert registers a kiosk at the branch and returns its ID and device key.
+// The key can't be recovered later, so it must be shown to the admin now.
+func (m *KioskModel) Insert(name string, branchID int) (int, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(b)
+
+	result, err := m.DB.Exec(
+		`INSERT INTO kiosk_devices (name, branch_id, key_hash, created) VALUES (?, ?, ?, NOW())`,
+		name, branchID, hashKioskKey(key),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(id), key, nil
+}
+
+// Authenticate returns the kiosk with this device key and records that it
+// was seen. Unknown and revoked keys fail with ErrInvalidCredentials.
+func (m *KioskModel) Authenticate(key string) (*Kiosk, error) {
+	k := &Kiosk{}
+	err := m.DB.QueryRow(kioskSelect+` WHERE k.key_hash = ? AND k.revoked_at IS NULL`, hashKioskKey(key)).Scan(kioskFields(k)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	_, err = m.DB.Exec(`UPDATE kiosk_devices SET last_seen = NOW() WHERE id = ?`, k.ID)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (m *KioskModel) List() ([]*Kiosk, error) {
+	rows, err := m.DB.Query(kioskSelect + ` ORDER BY k.revoked_at IS NOT NULL, k.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var kiosks []*Kiosk
+	for rows.Next() {
+		k := &Kiosk{}
+		err := rows.Scan(kioskFields(k)...)
+		if err != nil {
+			return nil, err
+		}
+		kiosks = append(kiosks, k)
+	}
+	return kiosks, rows.Err()
+}
+
+// Revoke stops the kiosk's key from working. Its past transactions keep
+// pointing at it.
+func (m *KioskModel) Revoke(id int) error {
+	result, err := m.DB.Exec(`UPDATE kiosk_devices SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// hashKioskKey is how device keys are stored. Keys are long and random, so a
+// plain SHA-256 is enough and lets them be looked up directly.
+func hashKioskKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+const kioskSelect = `SELECT k.id, k.name, k.branch_id, br.name, k.created, k.last_seen, k.revoked_at
+             FROM kiosk_devices k
+             JOIN branches br ON br.id = k.branch_id`
+
+func kioskFields(k *Kiosk) []any {
+	return []any{&k.ID, &k.Name, &k.BranchID, &k.BranchName, &k.Created, &k.LastSeen, &k.RevokedAt}
+}
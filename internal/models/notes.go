@@ -0,0 +1,62 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type PatronNoteModelInterface interface {
+	Add(userID, staffID int, note string) (int, error)
+	GetByUser(userID int) ([]*PatronNote, error)
+}
+
+// PatronNote is a remark staff keep on a patron's account. Patrons never see
+// their notes.
+type PatronNote struct {
+	ID        int
+	UserID    int
+	Note      string
+	StaffName string
+	Created   time.Time
+}
+
+type PatronNoteModel struct {
+	DB *sql.DB
+}
+
+func (m *PatronNoteModel) Add(userID, staffID int, note string) (int, error) {
+	result, err := m.DB.Exec(
+		`INSERT INTO patron_notes (user_id, staff_id, note, created) VALUES (?, ?, ?, NOW())`,
+		userID, staffID, note,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// GetByUser returns the notes on a patron's account, newest first.
+func (m *PatronNoteModel) GetByUser(userID int) ([]*PatronNote, error) {
+	rows, err := m.DB.Query(
+		`SELECT n.id, n.user_id, n.note, s.name, n.created FROM patron_notes n
+         JOIN users s ON s.id = n.staff_id
+         WHERE n.user_id = ? ORDER BY n.created DESC, n.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []*PatronNote
+	for rows.Next() {
+		n := &PatronNote{}
+		err := rows.Scan(&n.ID, &n.UserID, &n.Note, &n.StaffName, &n.Created)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
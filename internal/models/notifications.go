@@ -0,0 +1,73 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type NotificationModelInterface interface {
+	Send(userID int, message string) error
+	GetByUser(userID int) ([]*Notification, error)
+	MarkAllRead(userID int) error
+}
+
+// Notification is a message to a patron, shown in their inbox.
+type Notification struct {
+	ID      int
+	UserID  int
+	Message string
+	Created time.Time
+	ReadAt  *time.Time
+}
+
+type NotificationModel struct {
+	DB *sql.DB
+}
+
+// Send puts a message from staff in the user's inbox.
+func (m *NotificationModel) Send(userID int, message string) error {
+	return notify(m.DB, userID, message)
+}
+
+// GetByUser returns the user's 100 most recent notifications, newest first.
+func (m *NotificationModel) GetByUser(userID int) ([]*Notification, error) {
+	stmt := `SELECT id, user_id, message, created, read_at FROM notifications
+             WHERE user_id = ? ORDER BY created DESC, id DESC LIMIT 100`
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		n := &Notification{}
+		err := rows.Scan(&n.ID, &n.UserID, &n.Message, &n.Created, &n.ReadAt)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (m *NotificationModel) MarkAllRead(userID int) error {
+	_, err := m.DB.Exec(`UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL`, userID)
+	return err
+}
+
+// notify adds a message to the user's inbox.
+func notify(q querier, userID int, message string) error {
+	_, err := q.Exec(`INSERT INTO notifications (user_id, message, created) VALUES (?, ?, NOW())`, userID, message)
+	return err
+}
+
+// notifyLoan is notify for a message about one of the user's loans. The
+// message is deleted when the loan is anonymised; issueID 0 links no loan.
+func notifyLoan(q querier, userID, issueID int, message string) error {
+	_, err := q.Exec(
+		`INSERT INTO notifications (user_id, issue_id, message, created) VALUES (?, ?, ?, NOW())`,
+		userID, nullableID(issueID), message,
+	)
+	return err
+}
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type OverdueModelInterface interface {
+	Process() (*JobRun, error)
+	Runs(limit int) ([]*JobRun, error)
+	Notices(limit int) ([]*OverdueNotice, error)
+}
+
+// Overdue notice levels, in the order they're sent.
+const (
+	NoticeFirst  = "first"
+	NoticeSecond = "second"
+	NoticeFinal  = "final"
+)
+
+// What happens to a loan once its final notice has gone out.
+const (
+	FinalActionNone    = "none"
+	FinalActionSuspend = "suspend"
+	FinalActionLost    = "lost"
+)
+
+// suspendedOverdue is the patron_blocks reason for suspensions made by the
+// overdue processor.
+const suspendedOverdue = "Overdue after final notice"
+
+// NoticeRules says how many days overdue (counting open days only) a loan
+// must be before each notice is sent. A level with 0 days is never sent.
+type NoticeRules struct {
+	FirstDays   int
+	SecondDays  int
+	FinalDays   int
+	FinalAction string
+}
+
+// level returns the most serious notice due for a loan daysOverdue days
+// overdue, or "" if none is.
+func (r NoticeRules) level(daysOverdue int) string {
+	switch {
+	case r.FinalDays > 0 && daysOverdue >= r.FinalDays:
+		return NoticeFinal
+	case r.SecondDays > 0 && daysOverdue >= r.SecondDays:
+		return NoticeSecond
+	case r.FirstDays > 0 && daysOverdue >= r.FirstDays:
+		return NoticeFirst
+	default:
+		return ""
+	}
+}
+
+// noticeRank orders notice levels; 0 means none sent.
+func noticeRank(level string) int {
+	switch level {
+	case NoticeFirst:
+		return 1
+	case NoticeSecond:
+		return 2
+	case NoticeFinal:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// OverdueNotice is a notice sent to a patron about an overdue loan.
+type OverdueNotice struct {
+	ID          int
+	IssueID     int
+	RunID       int
+	Level       string
+	DaysOverdue int
+	BookTitle   string
+	UserName    string
+	Created     time.Time
+}
+
+type OverdueModel struct {
+	DB    *sql.DB
+	Rules NoticeRules
+	// Issues closes loans as lost when the final action is FinalActionLost.
+	Issues *IssueModel
+}
+
+// Process finds overdue loans and sends each the most serious notice it has
+// become due for, skipping any it has already had. Sending the final notice
+// also applies the final action. A loan that can't be processed is counted
+// as failed and the run carries on with the next. The run and every notice
+// are recorded; the run is returned even when it fails part way.
+func (m *OverdueModel) Process() (*JobRun, error) {
+	return runJob(m.DB, "overdue", m.sendNotices)
+}
+
+type overdueLoan struct {
+	issueID, userID int
+	title           string
+	dueDate         time.Time
+	sent            string
+}
+
+func (m *OverdueModel) sendNotices(runID int) (int, []error, error) {
+	stmt := `SELECT i.id, i.user_id, b.title, i.due_date,
+             COALESCE((SELECT n.level FROM overdue_notices n WHERE n.issue_id = i.id
+                       ORDER BY FIELD(n.level, 'first', 'second', 'final') DESC LIMIT 1), '')
+             FROM issues i
+             JOIN books b ON b.id = i.book_id
+             WHERE i.returned_at IS NULL AND i.due_date < NOW()
+             ORDER BY i.due_date`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return 0, nil, err
+	}
+	var loans []overdueLoan
+	earliest := time.Now()
+	for rows.Next() {
+		var l overdueLoan
+		err = rows.Scan(&l.issueID, &l.userID, &l.title, &l.dueDate, &l.sent)
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		if l.dueDate.Before(earliest) {
+			earliest = l.dueDate
+		}
+		loans = append(loans, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	cal, err := loadCalendar(m.DB, earliest)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sent := 0
+	var failures []error
+	now := time.Now()
+	for _, l := range loans {
+		days := cal.openDaysBetween(l.dueDate, now)
+		level := m.Rules.level(days)
+		if noticeRank(level) <= noticeRank(l.sent) {
+			continue
+		}
+		err = m.send(runID, l, level, days)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("issue %d: %w", l.issueID, err))
+			continue
+		}
+		sent++
+	}
+	return sent, failures, nil
+}
+
+func (m *OverdueModel) send(runID int, l overdueLoan, level string, days int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO overdue_notices (issue_id, run_id, level, days_overdue, created) VALUES (?, ?, ?, ?, NOW())`,
+		l.issueID, runID, level, days,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the notice is deleted with the loan's other messages when the loan is
+	// anonymised
+	loanID := l.issueID
+	msg := fmt.Sprintf("%q was due on %s and is %d days overdue. Please return it as soon as possible.",
+		l.title, l.dueDate.Format("02 Jan 2006"), days)
+	if level == NoticeFinal {
+		switch m.Rules.FinalAction {
+		case FinalActionSuspend:
+			msg = fmt.Sprintf("Final notice: %q was due on %s and is %d days overdue. Your borrowing is suspended until it is returned.",
+				l.title, l.dueDate.Format("02 Jan 2006"), days)
+			err = suspend(tx, l.userID, suspendedOverdue)
+			if err != nil {
+				return err
+			}
+		case FinalActionLost:
+			var cost int
+			cost, err = m.Issues.declareLoss(tx, l.issueID, 0, LossLost, "Not returned after final overdue notice")
+			if err != nil {
+				return err
+			}
+			outcome := "It has been marked lost."
+			if cost > 0 {
+				outcome = "It has been marked lost and you have been charged its replacement cost."
+			}
+			msg = fmt.Sprintf("Final notice: %q was due on %s and is %d days overdue. %s",
+				l.title, l.dueDate.Format("02 Jan 2006"), days, outcome)
+			// declaring the loss closed the loan and may already have
+			// anonymised it, so this notice isn't tied to the loan
+			loanID = 0
+		default:
+			msg = "Final notice: " + msg
+		}
+	}
+	err = notifyLoan(tx, l.userID, loanID, msg)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Runs returns the most recent overdue processor runs, newest first.
+func (m *OverdueModel) Runs(limit int) ([]*JobRun, error) {
+	stmt := `SELECT id, job, started_at, finished_at, processed, failed, error FROM job_runs
+             WHERE job = 'overdue' ORDER BY started_at DESC, id DESC LIMIT ?`
+	rows, err := m.DB.Query(stmt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*JobRun
+	for rows.Next() {
+		r := &JobRun{}
+		err := rows.Scan(&r.ID, &r.Job, &r.StartedAt, &r.FinishedAt, &r.Processed, &r.Failed, &r.Error)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// Notices returns the most recently sent overdue notices, newest first.
+func (m *OverdueModel) Notices(limit int) ([]*OverdueNotice, error) {
+	stmt := `SELECT n.id, n.issue_id, n.run_id, n.level, n.days_overdue, b.title, COALESCE(u.name, ''), n.created
+             FROM overdue_notices n
+             JOIN issues i ON i.id = n.issue_id
+             JOIN books b ON b.id = i.book_id
+             LEFT JOIN users u ON u.id = i.user_id
+             ORDER BY n.created DESC, n.id DESC LIMIT ?`
+	rows, err := m.DB.Query(stmt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notices []*OverdueNotice
+	for rows.Next() {
+		n := &OverdueNotice{}
+		err := rows.Scan(&n.ID, &n.IssueID, &n.RunID, &n.Level, &n.DaysOverdue, &n.BookTitle, &n.UserName, &n.Created)
+		if err != nil {
+			return nil, err
+		}
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
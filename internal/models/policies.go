@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type LoanPolicyModelInterface interface {
+	Get(role string) (*LoanPolicy, error)
+	List() ([]*LoanPolicy, error)
+	Update(p *LoanPolicy) error
+}
+
+// LoanPolicy holds the borrowing rules for one user role.
+type LoanPolicy struct {
+	Role        string
+	LoanDays    int
+	MaxLoans    int
+	MaxRenewals int
+	// GraceDays is how far past the due date a loan can still be renewed.
+	GraceDays int
+	// RecallMinDays is the loan period a borrower is guaranteed even if the
+	// book is recalled.
+	RecallMinDays int
+}
+
+type LoanPolicyModel struct {
+	DB *sql.DB
+}
+
+func (m *LoanPolicyModel) Get(role string) (*LoanPolicy, error) {
+	p := &LoanPolicy{}
+	stmt := `SELECT role, loan_days, max_loans, max_renewals, grace_days, recall_min_days FROM loan_policies WHERE role = ?`
+	err := m.DB.QueryRow(stmt, role).Scan(&p.Role, &p.LoanDays, &p.MaxLoans, &p.MaxRenewals, &p.GraceDays, &p.RecallMinDays)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+func (m *LoanPolicyModel) List() ([]*LoanPolicy, error) {
+	rows, err := m.DB.Query(`SELECT role, loan_days, max_loans, max_renewals, grace_days, recall_min_days FROM loan_policies ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []*LoanPolicy
+	for rows.Next() {
+		p := &LoanPolicy{}
+		err := rows.Scan(&p.Role, &p.LoanDays, &p.MaxLoans, &p.MaxRenewals, &p.GraceDays, &p.RecallMinDays)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+func (m *LoanPolicyModel) Update(p *LoanPolicy) error {
+	stmt := `UPDATE loan_policies SET loan_days = ?, max_loans = ?, max_renewals = ?, grace_days = ?, recall_min_days = ?
+             WHERE role = ?`
+	result, err := m.DB.Exec(stmt, p.LoanDays, p.MaxLoans, p.MaxRenewals, p.GraceDays, p.RecallMinDays, p.Role)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// RowsAffected is 0 when nothing changed too, so double check the row exists
+	if n == 0 {
+		var exists bool
+		err = m.DB.QueryRow(`SELECT EXISTS(SELECT true FROM loan_policies WHERE role = ?)`, p.Role).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// policyForUser looks up the loan policy for the user's current role.
+func policyForUser(q querier, userID int) (*LoanPolicy, error) {
+	p := &LoanPolicy{}
+	stmt := `SELECT lp.role, lp.loan_days, lp.max_loans, lp.max_renewals, lp.grace_days, lp.recall_min_days
+             FROM loan_policies lp
+             JOIN users u ON u.role = lp.role
+             WHERE u.id = ?`
+	err := q.QueryRow(stmt, userID).Scan(&p.Role, &p.LoanDays, &p.MaxLoans, &p.MaxRenewals, &p.GraceDays, &p.RecallMinDays)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoLoanPolicy
+		}
+		return nil, err
+	}
+	return p, nil
+}
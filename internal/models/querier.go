@@ -0,0 +1,11 @@
+package models
+
+import "database/sql"
+
+// querier is satisfied by both *sql.DB and *sql.Tx so helpers can run inside
+// or outside a transaction.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
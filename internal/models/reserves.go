@@ -0,0 +1,208 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// overnightDueHour is the hour of the next open day when an overnight loan
+// is due back.
+const overnightDueHour = 10
+
+type ReserveModelInterface interface {
+	Insert(courseCode, instructor, term string, endsOn time.Time, loanHours int) (int, error)
+	Get(id int) (*Reserve, error)
+	List(includeExpired bool) ([]*Reserve, error)
+	Books(reserveID int) ([]*Book, error)
+	AddBook(reserveID, bookID int) error
+	RemoveBook(reserveID, bookID int) error
+	ByBook() (map[int][]*Reserve, error)
+}
+
+// Reserve is a course reserve list: books set aside for a course for a term
+// and lent on a short loan until the term ends.
+type Reserve struct {
+	ID         int
+	CourseCode string
+	Instructor string
+	Term       string
+	// EndsOn is the last day of the reserve; the books go back to the
+	// normal loan policy after it.
+	EndsOn time.Time
+	// LoanHours is the short loan period. 0 means overnight: due back at
+	// overnightDueHour on the next open day.
+	LoanHours int
+	Created   time.Time
+	BookCount int
+}
+
+// Expired reports whether the reserve's term has ended.
+func (r *Reserve) Expired() bool {
+	return dateOf(time.Now()).After(dateOf(r.EndsOn))
+}
+
+type ReserveModel struct {
+	DB *sql.DB
+}
+
+func (m *ReserveModel) Insert(courseCode, instructor, term string, endsOn time.Time, loanHours int) (int, error) {
+	result, err := m.DB.Exec(
+		`INSERT INTO course_reserves (course_code, instructor, term, ends_on, loan_hours, created) VALUES (?, ?, ?, ?, ?, NOW())`,
+		courseCode, instructor, term, endsOn.Format("2006-01-02"), loanHours,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *ReserveModel) Get(id int) (*Reserve, error) {
+	r := &Reserve{}
+	err := m.DB.QueryRow(reserveSelect+` WHERE r.id = ? GROUP BY r.id`, id).Scan(reserveFields(r)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// List returns the reserves ordered by course code, current ones only unless
+// includeExpired is set.
+func (m *ReserveModel) List(includeExpired bool) ([]*Reserve, error) {
+	stmt := reserveSelect
+	if !includeExpired {
+		stmt += ` WHERE r.ends_on >= CURDATE()`
+	}
+	rows, err := m.DB.Query(stmt + ` GROUP BY r.id ORDER BY r.course_code, r.ends_on DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanReserves(rows)
+}
+
+// Books returns the books on a reserve list, with their availability.
+func (m *ReserveModel) Books(reserveID int) ([]*Book, error) {
+	rows, err := m.DB.Query(
+		bookSelect+` JOIN course_reserve_books rb ON rb.book_id = b.id WHERE rb.reserve_id = ? ORDER BY b.title`,
+		reserveID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBooks(rows)
+}
+
+// AddBook puts a book on a reserve list. Adding a book that is already on
+// the list does nothing.
+func (m *ReserveModel) AddBook(reserveID, bookID int) error {
+	_, err := m.DB.Exec(`INSERT IGNORE INTO course_reserve_books (reserve_id, book_id) VALUES (?, ?)`, reserveID, bookID)
+	return err
+}
+
+// RemoveBook takes a book off a reserve list. Loans already made keep their
+// short due date.
+func (m *ReserveModel) RemoveBook(reserveID, bookID int) error {
+	_, err := m.DB.Exec(`DELETE FROM course_reserve_books WHERE reserve_id = ? AND book_id = ?`, reserveID, bookID)
+	return err
+}
+
+// ByBook returns the current reserves each book is on, keyed by book ID.
+func (m *ReserveModel) ByBook() (map[int][]*Reserve, error) {
+	rows, err := m.DB.Query(
+		`SELECT rb.book_id, r.id, r.course_code, r.instructor, r.term, r.ends_on, r.loan_hours, r.created
+         FROM course_reserves r
+         JOIN course_reserve_books rb ON rb.reserve_id = r.id
+         WHERE r.ends_on >= CURDATE()
+         ORDER BY r.course_code`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reserves := make(map[int][]*Reserve)
+	for rows.Next() {
+		var bookID int
+		r := &Reserve{}
+		err := rows.Scan(&bookID, &r.ID, &r.CourseCode, &r.Instructor, &r.Term, &r.EndsOn, &r.LoanHours, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+		reserves[bookID] = append(reserves[bookID], r)
+	}
+	return reserves, rows.Err()
+}
+
+// loanDueDate works out when a loan of the book made at from is due back.
+// A book on a current course reserve gets the reserve's short loan, the
+// shortest if it is on several; it returns that reserve's ID. Otherwise the
+// book's item type sets the loan period if it has one, or else the policy
+// does, and the ID is 0.
+func loanDueDate(q querier, bookID int, from time.Time, policy *LoanPolicy) (time.Time, int, error) {
+	var reserveID, loanHours int
+	err := q.QueryRow(
+		`SELECT r.id, r.loan_hours FROM course_reserves r
+         JOIN course_reserve_books rb ON rb.reserve_id = r.id
+         WHERE rb.book_id = ? AND r.ends_on >= CURDATE()
+         ORDER BY r.loan_hours = 0, r.loan_hours LIMIT 1`,
+		bookID,
+	).Scan(&reserveID, &loanHours)
+	if errors.Is(err, sql.ErrNoRows) {
+		var typeDays int
+		err = q.QueryRow(
+			`SELECT COALESCE(t.loan_days, 0) FROM books b JOIN item_types t ON t.id = b.item_type_id WHERE b.id = ?`,
+			bookID,
+		).Scan(&typeDays)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		days := policy.LoanDays
+		if typeDays > 0 {
+			days = typeDays
+		}
+		due, err := dueDateFrom(q, from, days)
+		return due, 0, err
+	}
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	due := from.Add(time.Duration(loanHours) * time.Hour)
+	if loanHours == 0 {
+		due = time.Date(from.Year(), from.Month(), from.Day()+1, overnightDueHour, 0, 0, 0, from.Location())
+	}
+	c, err := loadCalendar(q, due)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return c.nextOpen(due), reserveID, nil
+}
+
+// reserveSelect counts each reserve's books; callers add their WHERE and
+// GROUP BY r.id.
+const reserveSelect = `SELECT r.id, r.course_code, r.instructor, r.term, r.ends_on, r.loan_hours, r.created, COUNT(rb.book_id)
+             FROM course_reserves r
+             LEFT JOIN course_reserve_books rb ON rb.reserve_id = r.id`
+
+func reserveFields(r *Reserve) []any {
+	return []any{&r.ID, &r.CourseCode, &r.Instructor, &r.Term, &r.EndsOn, &r.LoanHours, &r.Created, &r.BookCount}
+}
+
+func scanReserves(rows *sql.Rows) ([]*Reserve, error) {
+	var reserves []*Reserve
+	for rows.Next() {
+		r := &Reserve{}
+		err := rows.Scan(reserveFields(r)...)
+		if err != nil {
+			return nil, err
+		}
+		reserves = append(reserves, r)
+	}
+	return reserves, rows.Err()
+}
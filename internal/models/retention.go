@@ -0,0 +1,51 @@
+package models
+
+import "database/sql"
+
+type RetentionModelInterface interface {
+	Process() (*JobRun, error)
+}
+
+type RetentionModel struct {
+	DB *sql.DB
+	// Days is how long a returned loan stays linked to its patron. 0 keeps
+	// loans linked forever.
+	Days int
+}
+
+// Process anonymises loans returned more than Days ago: the patron and the
+// name of anyone who recalled the loan are cleared, while the book and dates
+// are kept for circulation statistics. Their settled fines and inbox messages
+// are unlinked too. Loans with fines still owing are left until the fine is
+// settled. The run is recorded in job_runs with the number of loans changed.
+func (m *RetentionModel) Process() (*JobRun, error) {
+	return runJob(m.DB, "retention", func(int) (int, []error, error) {
+		if m.Days <= 0 {
+			return 0, nil, nil
+		}
+		tx, err := m.DB.Begin()
+		if err != nil {
+			return 0, nil, err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(
+			`UPDATE issues i SET i.user_id = NULL, i.recall_requested_by = ''
+             WHERE i.user_id IS NOT NULL AND i.returned_at < NOW() - INTERVAL ? DAY
+             AND NOT EXISTS (`+unpaidFineSelect+`)`,
+			m.Days,
+		)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, nil, err
+		}
+		err = unlinkAnonymised(tx, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		return int(n), nil, tx.Commit()
+	})
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type SubscriptionModelInterface interface {
+	Subscribe(bookID, userID int) (int, error)
+	Cancel(id, userID int) error
+	GetByUser(userID int) ([]*Subscription, error)
+}
+
+// Subscription asks for a notification when a copy of a book is back on the
+// shelf. Unlike a hold it doesn't keep a copy for the patron; it ends as
+// soon as the notification goes out.
+type Subscription struct {
+	ID        int
+	BookID    int
+	UserID    int
+	BookTitle string
+	Created   time.Time
+}
+
+type SubscriptionModel struct {
+	DB *sql.DB
+}
+
+// Subscribe signs the user up to hear when the book is available again. Like
+// holds, subscriptions are only taken while every copy is out.
+func (m *SubscriptionModel) Subscribe(bookID, userID int) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = lockLendableBook(tx, bookID)
+	if err != nil {
+		return 0, err
+	}
+	var available int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM book_copies WHERE book_id = ? AND status = 'available'`, bookID).Scan(&available)
+	if err != nil {
+		return 0, err
+	}
+	if available > 0 {
+		return 0, ErrCopiesAvailable
+	}
+
+	result, err := tx.Exec(`INSERT INTO book_subscriptions (book_id, user_id, created) VALUES (?, ?, NOW())`, bookID, userID)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "book_subscriptions_uc_book_user") {
+				return 0, ErrAlreadySubscribed
+			}
+		}
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// Cancel removes one of the user's own subscriptions.
+func (m *SubscriptionModel) Cancel(id, userID int) error {
+	result, err := m.DB.Exec(`DELETE FROM book_subscriptions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+func (m *SubscriptionModel) GetByUser(userID int) ([]*Subscription, error) {
+	rows, err := m.DB.Query(
+		`SELECT s.id, s.book_id, s.user_id, b.title, s.created
+         FROM book_subscriptions s
+         JOIN books b ON b.id = s.book_id
+         WHERE s.user_id = ? ORDER BY s.created DESC, s.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+	for rows.Next() {
+		s := &Subscription{}
+		err := rows.Scan(&s.ID, &s.BookID, &s.UserID, &s.BookTitle, &s.Created)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// notifySubscribers is called whenever a copy of the book goes back on the
+// shelf. Subscriptions only exist while no copy is available, so this is the
+// book going from none available to one: every subscriber is told and their
+// subscriptions end.
+func notifySubscribers(q querier, bookID int) error {
+	return endSubscriptions(q, bookID, "%q is back on the shelf. Issue it soon - we don't keep it aside for you.")
+}
+
+// endSubscriptions sends each of the book's subscribers the message, with
+// the title in place of %q, and removes the subscriptions.
+func endSubscriptions(q querier, bookID int, format string) error {
+	rows, err := q.Query(
+		`SELECT s.user_id, b.title FROM book_subscriptions s JOIN books b ON b.id = s.book_id WHERE s.book_id = ?`,
+		bookID,
+	)
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	var title string
+	for rows.Next() {
+		var userID int
+		err = rows.Scan(&userID, &title)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	for _, userID := range userIDs {
+		err = notify(q, userID, fmt.Sprintf(format, title))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = q.Exec(`DELETE FROM book_subscriptions WHERE book_id = ?`, bookID)
+	return err
+}
@@ -0,0 +1,318 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type SuggestionModelInterface interface {
+	Insert(userID int, title, author, isbn string) (int, error)
+	Get(id int) (*Suggestion, error)
+	List(status string) ([]*Suggestion, error)
+	GetByUser(userID int) ([]*Suggestion, error)
+	Approve(id, staffID int) error
+	Reject(id, staffID int, reason string) error
+	Order(id, staffID int, vendor string, cost int, expectedOn time.Time) error
+	Receive(id, staffID int, isbn string, copies, branchID, itemTypeID int) (int, error)
+	Budget(year int) (*BudgetReport, error)
+	SetBudget(year, amount int) error
+}
+
+// Suggestion statuses. A suggestion is triaged from pending to approved or
+// rejected; approved (or pending) ones can be ordered, and an order becomes
+// received once the book is in the catalogue.
+const (
+	SuggestionPending  = "pending"
+	SuggestionApproved = "approved"
+	SuggestionRejected = "rejected"
+	SuggestionOrdered  = "ordered"
+	SuggestionReceived = "received"
+)
+
+// Suggestion is a patron's request for the library to buy a book, and the
+// order placed for it if there is one. Amounts are in cents.
+type Suggestion struct {
+	ID     int
+	UserID int
+	// UserName is who suggested the book.
+	UserName string
+	Title    string
+	Author   string
+	// ISBN is empty if the patron didn't know it.
+	ISBN   string
+	Status string
+	// Reason is why the suggestion was rejected.
+	Reason     string
+	Vendor     string
+	Cost       int
+	ExpectedOn *time.Time
+	OrderedAt  *time.Time
+	ReceivedAt *time.Time
+	// BookID is the catalogue book made when the order arrived, or 0 if
+	// there is none or it has since been purged.
+	BookID int
+	// ReviewedByName is the staff member who last moved the suggestion on.
+	ReviewedByName string
+	Created        time.Time
+}
+
+// BudgetReport sums up a year's acquisitions. Orders count against the year
+// they were placed in. Amounts are in cents.
+type BudgetReport struct {
+	Year int
+	// Budget is 0 when none has been set for the year.
+	Budget  int
+	Spent   int
+	OnOrder int
+	Orders  []*Suggestion
+}
+
+// Remaining is what's left of the budget once every order placed in the
+// year, received or not, is paid for.
+func (b *BudgetReport) Remaining() int {
+	return b.Budget - b.Spent - b.OnOrder
+}
+
+type SuggestionModel struct {
+	DB *sql.DB
+}
+
+func (m *SuggestionModel) Insert(userID int, title, author, isbn string) (int, error) {
+	result, err := m.DB.Exec(
+		`INSERT INTO purchase_suggestions (user_id, title, author, isbn, created) VALUES (?, ?, ?, ?, NOW())`,
+		userID, title, author, isbn,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (m *SuggestionModel) Get(id int) (*Suggestion, error) {
+	s := &Suggestion{}
+	err := m.DB.QueryRow(suggestionSelect+` WHERE s.id = ?`, id).Scan(suggestionFields(s)...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the suggestions with the given status, oldest first, or every
+// open one (pending, approved or ordered) if status is empty.
+func (m *SuggestionModel) List(status string) ([]*Suggestion, error) {
+	stmt := suggestionSelect + ` WHERE s.status IN ('pending', 'approved', 'ordered')`
+	args := []any{}
+	if status != "" {
+		stmt = suggestionSelect + ` WHERE s.status = ?`
+		args = append(args, status)
+	}
+	rows, err := m.DB.Query(stmt+` ORDER BY s.created, s.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSuggestions(rows)
+}
+
+// GetByUser returns the user's suggestions, newest first.
+func (m *SuggestionModel) GetByUser(userID int) ([]*Suggestion, error) {
+	rows, err := m.DB.Query(suggestionSelect+` WHERE s.user_id = ? ORDER BY s.created DESC, s.id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSuggestions(rows)
+}
+
+func (m *SuggestionModel) Approve(id, staffID int) error {
+	return m.advance(m.DB, id,
+		`UPDATE purchase_suggestions SET status = 'approved', reviewed_by = ? WHERE id = ? AND status = 'pending'`,
+		staffID, id,
+	)
+}
+
+// Reject turns down a suggestion that hasn't been ordered and tells the
+// patron why.
+func (m *SuggestionModel) Reject(id, staffID int, reason string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.advance(tx, id,
+		`UPDATE purchase_suggestions SET status = 'rejected', reason = ?, reviewed_by = ? WHERE id = ? AND status IN ('pending', 'approved')`,
+		reason, staffID, id,
+	)
+	if err != nil {
+		return err
+	}
+	err = m.notifyRequester(tx, id, "We won't be buying %q, which you suggested: %s", reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Order records that a suggestion has been ordered from vendor at cost.
+func (m *SuggestionModel) Order(id, staffID int, vendor string, cost int, expectedOn time.Time) error {
+	return m.advance(m.DB, id,
+		`UPDATE purchase_suggestions SET status = 'ordered', vendor = ?, cost = ?, expected_on = ?, ordered_at = NOW(), reviewed_by = ?
+         WHERE id = ? AND status IN ('pending', 'approved')`,
+		vendor, cost, expectedOn.Format("2006-01-02"), staffID, id,
+	)
+}
+
+// Receive adds an ordered book to the catalogue with copies copies at
+// branchID, the order's cost split across them as their replacement cost,
+// then closes the order and tells the patron who suggested it. It returns
+// the new book's ID, or fails with ErrDuplicateISBN if the ISBN is already
+// in the catalogue.
+func (m *SuggestionModel) Receive(id, staffID int, isbn string, copies, branchID, itemTypeID int) (int, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var title, author, status string
+	var cost int
+	err = tx.QueryRow(
+		`SELECT title, author, status, cost FROM purchase_suggestions WHERE id = ? FOR UPDATE`, id,
+	).Scan(&title, &author, &status, &cost)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	if status != SuggestionOrdered {
+		return 0, ErrSuggestionStage
+	}
+
+	bookID, err := insertBook(tx, title, author, isbn, copies, cost/copies, branchID, itemTypeID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		`UPDATE purchase_suggestions SET status = 'received', book_id = ?, received_at = NOW(), reviewed_by = ? WHERE id = ?`,
+		bookID, staffID, id,
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = m.notifyRequester(tx, id, "%q, which you suggested, is now in the catalogue.")
+	if err != nil {
+		return 0, err
+	}
+	return bookID, tx.Commit()
+}
+
+// Budget reports the year's acquisitions budget and the orders placed
+// against it.
+func (m *SuggestionModel) Budget(year int) (*BudgetReport, error) {
+	b := &BudgetReport{Year: year}
+	err := m.DB.QueryRow(`SELECT amount FROM acquisition_budgets WHERE year = ?`, year).Scan(&b.Budget)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	rows, err := m.DB.Query(
+		suggestionSelect+` WHERE s.ordered_at IS NOT NULL AND YEAR(s.ordered_at) = ? ORDER BY s.ordered_at, s.id`,
+		year,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	b.Orders, err = scanSuggestions(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range b.Orders {
+		if s.Status == SuggestionReceived {
+			b.Spent += s.Cost
+		} else {
+			b.OnOrder += s.Cost
+		}
+	}
+	return b, nil
+}
+
+// SetBudget sets the acquisitions budget for the year, replacing any
+// earlier amount.
+func (m *SuggestionModel) SetBudget(year, amount int) error {
+	_, err := m.DB.Exec(
+		`INSERT INTO acquisition_budgets (year, amount) VALUES (?, ?) ON DUPLICATE KEY UPDATE amount = VALUES(amount)`,
+		year, amount,
+	)
+	return err
+}
+
+// advance runs an UPDATE that moves a suggestion on from the statuses it
+// allows. It fails with ErrSuggestionStage if the suggestion is at another
+// stage.
+func (m *SuggestionModel) advance(q querier, id int, stmt string, args ...any) error {
+	result, err := q.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var exists bool
+		err = q.QueryRow(`SELECT EXISTS(SELECT true FROM purchase_suggestions WHERE id = ?)`, id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+		return ErrSuggestionStage
+	}
+	return nil
+}
+
+// notifyRequester sends the patron who made the suggestion a message: format
+// is filled in with the suggested title, then args.
+func (m *SuggestionModel) notifyRequester(q querier, id int, format string, args ...any) error {
+	var userID int
+	var title string
+	err := q.QueryRow(`SELECT user_id, title FROM purchase_suggestions WHERE id = ?`, id).Scan(&userID, &title)
+	if err != nil {
+		return err
+	}
+	return notify(q, userID, fmt.Sprintf(format, append([]any{title}, args...)...))
+}
+
+const suggestionSelect = `SELECT s.id, s.user_id, u.name, s.title, s.author, s.isbn, s.status, s.reason, s.vendor, s.cost,
+             s.expected_on, s.ordered_at, s.received_at, COALESCE(s.book_id, 0), COALESCE(r.name, ''), s.created
+             FROM purchase_suggestions s
+             JOIN users u ON u.id = s.user_id
+             LEFT JOIN users r ON r.id = s.reviewed_by`
+
+func suggestionFields(s *Suggestion) []any {
+	return []any{&s.ID, &s.UserID, &s.UserName, &s.Title, &s.Author, &s.ISBN, &s.Status, &s.Reason, &s.Vendor, &s.Cost,
+		&s.ExpectedOn, &s.OrderedAt, &s.ReceivedAt, &s.BookID, &s.ReviewedByName, &s.Created}
+}
+
+func scanSuggestions(rows *sql.Rows) ([]*Suggestion, error) {
+	var suggestions []*Suggestion
+	for rows.Next() {
+		s := &Suggestion{}
+		err := rows.Scan(suggestionFields(s)...)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+type TransferModelInterface interface {
+	Receive(copyID, staffID, branchID int) (string, error)
+	InTransit(minDays int, branchIDs []int) ([]*Transfer, error)
+}
+
+// Transfer is a copy's trip back to its home branch after being returned at
+// another one.
+type Transfer struct {
+	ID         int
+	CopyID     int
+	Barcode    string
+	BookTitle  string
+	FromBranch string
+	ToBranchID int
+	ToBranch   string
+	SentAt     time.Time
+	// SentByName is the staff member who checked the copy in; empty for
+	// kiosk returns.
+	SentByName string
+}
+
+// Days is how many whole days the copy has been in transit.
+func (t *Transfer) Days() int {
+	return int(time.Since(t.SentAt).Hours() / 24)
+}
+
+type TransferModel struct {
+	DB *sql.DB
+	// HoldPickupDays is how long a received copy is kept for the next hold.
+	HoldPickupDays int
+}
+
+// Receive records that a copy in transit has arrived at branchID, its home
+// branch, and puts it back into circulation there: set aside for the next
+// hold or back on the shelf. It fails with ErrNotInTransit if the copy isn't
+// in transit and ErrWrongBranch if it is heading to another branch. It
+// returns the copy's new status.
+func (m *TransferModel) Receive(copyID, staffID, branchID int) (string, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	status, err := lockCopy(tx, copyID)
+	if err != nil {
+		return "", err
+	}
+	if status != CopyInTransit {
+		return "", ErrNotInTransit
+	}
+
+	var id, toBranchID int
+	err = tx.QueryRow(
+		`SELECT id, to_branch_id FROM transfers WHERE copy_id = ? AND received_at IS NULL FOR UPDATE`,
+		copyID,
+	).Scan(&id, &toBranchID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotInTransit
+		}
+		return "", err
+	}
+	if toBranchID != branchID {
+		return "", ErrWrongBranch
+	}
+
+	_, err = tx.Exec(`UPDATE transfers SET received_at = NOW(), received_by = ? WHERE id = ?`, staffID, id)
+	if err != nil {
+		return "", err
+	}
+	err = releaseCopy(tx, copyID, m.HoldPickupDays)
+	if err != nil {
+		return "", err
+	}
+	err = tx.QueryRow(`SELECT status FROM book_copies WHERE id = ?`, copyID).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+	return status, tx.Commit()
+}
+
+// InTransit returns the copies that have been in transit for at least
+// minDays, longest first. A non-nil branchIDs limits it to transfers from or
+// to those branches.
+func (m *TransferModel) InTransit(minDays int, branchIDs []int) ([]*Transfer, error) {
+	stmt := transferSelect + ` WHERE t.received_at IS NULL AND t.sent_at <= DATE_SUB(NOW(), INTERVAL ? DAY)`
+	args := []any{minDays}
+	if branchIDs != nil {
+		if len(branchIDs) == 0 {
+			return nil, nil
+		}
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(branchIDs)), ", ")
+		stmt += ` AND (t.from_branch_id IN (` + in + `) OR t.to_branch_id IN (` + in + `))`
+		for _, id := range branchIDs {
+			args = append(args, id)
+		}
+		args = append(args, args[1:]...)
+	}
+	rows, err := m.DB.Query(stmt+` ORDER BY t.sent_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []*Transfer
+	for rows.Next() {
+		t := &Transfer{}
+		err := rows.Scan(&t.ID, &t.CopyID, &t.Barcode, &t.BookTitle, &t.FromBranch, &t.ToBranchID, &t.ToBranch, &t.SentAt, &t.SentByName)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// shelveReturnedCopy puts a copy that has just come back into circulation.
+// Returned at its home branch, or somewhere unknown (branchID 0), it goes to
+// the next hold or back on the shelf; returned anywhere else it is sent home
+// and stays in transit until that branch receives it.
+func shelveReturnedCopy(tx *sql.Tx, copyID, branchID, staffID, pickupDays int) error {
+	var homeBranchID int
+	err := tx.QueryRow(`SELECT branch_id FROM book_copies WHERE id = ?`, copyID).Scan(&homeBranchID)
+	if err != nil {
+		return err
+	}
+	if branchID == 0 || branchID == homeBranchID {
+		return releaseCopy(tx, copyID, pickupDays)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO transfers (copy_id, from_branch_id, to_branch_id, sent_at, sent_by) VALUES (?, ?, ?, NOW(), ?)`,
+		copyID, branchID, homeBranchID, nullableID(staffID),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE book_copies SET status = 'in_transit' WHERE id = ?`, copyID)
+	return err
+}
+
+const transferSelect = `SELECT t.id, t.copy_id, c.barcode, b.title, fb.name, t.to_branch_id, tb.name, t.sent_at, COALESCE(s.name, '')
+             FROM transfers t
+             JOIN book_copies c ON c.id = t.copy_id
+             JOIN books b ON b.id = c.book_id
+             JOIN branches fb ON fb.id = t.from_branch_id
+             JOIN branches tb ON tb.id = t.to_branch_id
+             LEFT JOIN users s ON s.id = t.sent_by`
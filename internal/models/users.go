@@ -20,6 +20,14 @@ type UserModelInterface interface {
 	GetRole(id int) (string, error)
 	PromoteToLibrarian(id int) error
 	ListUsers() ([]*User, error)
+	Search(query string) ([]*User, error)
+	SetCardNumber(id int, cardNumber string) error
+	GetByCardNumber(cardNumber string) (*User, error)
+	SetPIN(id int, pin string) error
+	AuthenticatePIN(cardNumber, pin string) (int, error)
+	SetKeepHistory(id int, keep bool) error
+	SetDefaultBranch(id, branchID int) error
+	RenewMembership(id int) error
 }
 
 type User struct {
@@ -29,10 +37,31 @@ type User struct {
 	HashedPassword []byte
 	Created        time.Time
 	Role           string
+	CardNumber     string
+	// CardExpires is the last day of the user's membership; nil if it never
+	// expires, as for staff and accounts from before memberships expired.
+	CardExpires *time.Time
+	// KeepHistory is false when the user has asked for their returned loans
+	// not to be kept against their account.
+	KeepHistory bool
+	// HasPIN reports whether the user has a PIN for self-service kiosks.
+	HasPIN bool
+	// DefaultBranchID is the branch the user normally borrows from, or for
+	// staff the branch they are working at; 0 if none is set.
+	DefaultBranchID   int
+	DefaultBranchName string
+}
+
+// MembershipExpired reports whether the user's membership has run out.
+func (u *User) MembershipExpired() bool {
+	return u.CardExpires != nil && dateOf(time.Now()).After(dateOf(*u.CardExpires))
 }
 
 type UserModel struct {
 	DB *sql.DB
+	// MembershipMonths is how long a membership lasts from sign-up or
+	// renewal; 0 means memberships never expire.
+	MembershipMonths int
 }
 
 func (m *UserModel) Insert(name, email, password string) (int, error) {
@@ -41,10 +70,10 @@ func (m *UserModel) Insert(name, email, password string) (int, error) {
 		return 0, err
 	}
 
-	stmt := `INSERT INTO users (name, email, hashed_password, created)
-    VALUES(?, ?, ?, NOW())`
+	stmt := `INSERT INTO users (name, email, hashed_password, created, card_expires)
+    VALUES(?, ?, ?, NOW(), IF(? > 0, DATE_ADD(CURDATE(), INTERVAL ? MONTH), NULL))`
 
-	result, err := m.DB.Exec(stmt, name, email, hashedPassword)
+	result, err := m.DB.Exec(stmt, name, email, hashedPassword, m.MembershipMonths, m.MembershipMonths)
 	if err != nil {
 		// Checking if the error is for duplicate email
 		var mysqlErr *mysql.MySQLError
@@ -105,9 +134,12 @@ func (m *UserModel) Exists(id int) (bool, error) {
 func (m *UserModel) GetUserInfo(id int) (*User, error) {
 	user := &User{}
 
-	stmt := "SELECT id, name, email, created, role FROM users WHERE id = ?"
+	stmt := `SELECT u.id, u.name, u.email, u.created, u.role, COALESCE(u.card_number, ''), u.card_expires, u.keep_history, u.pin_hash IS NOT NULL,
+    COALESCE(u.default_branch_id, 0), COALESCE(br.name, '')
+    FROM users u LEFT JOIN branches br ON br.id = u.default_branch_id WHERE u.id = ?`
 
-	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.Created, &user.Role)
+	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.Created, &user.Role, &user.CardNumber, &user.CardExpires, &user.KeepHistory, &user.HasPIN,
+		&user.DefaultBranchID, &user.DefaultBranchName)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -170,16 +202,165 @@ func (m *UserModel) PromoteToLibrarian(id int) error {
 }
 
 func (m *UserModel) ListUsers() ([]*User, error) {
-	rows, err := m.DB.Query("SELECT id, name, email, created, role FROM users ORDER BY created DESC")
+	rows, err := m.DB.Query("SELECT id, name, email, created, role, COALESCE(card_number, ''), card_expires FROM users ORDER BY created DESC")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// Search finds patrons by exact library card number, or by partial email or
+// name.
+func (m *UserModel) Search(query string) ([]*User, error) {
+	like := "%" + query + "%"
+	stmt := `SELECT id, name, email, created, role, COALESCE(card_number, ''), card_expires FROM users
+             WHERE card_number = ? OR email LIKE ? OR name LIKE ?
+             ORDER BY name
+             LIMIT 50`
+	rows, err := m.DB.Query(stmt, query, like, like)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// SetCardNumber assigns a library card to the user. An empty card number
+// removes it.
+func (m *UserModel) SetCardNumber(id int, cardNumber string) error {
+	var card any
+	if cardNumber != "" {
+		card = cardNumber
+	}
+	_, err := m.DB.Exec("UPDATE users SET card_number = ? WHERE id = ?", card, id)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_card_number") {
+				return ErrDuplicateCardNumber
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// SetKeepHistory turns the user's borrowing history on or off. Turning it off
+// anonymises their returned loans straight away, except any with fines still
+// owing, and every loan they return from then on.
+func (m *UserModel) SetKeepHistory(id int, keep bool) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET keep_history = ? WHERE id = ?", keep, id)
+	if err != nil {
+		return err
+	}
+	err = forgetHistory(tx, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetDefaultBranch sets the user's branch; 0 clears it.
+func (m *UserModel) SetDefaultBranch(id, branchID int) error {
+	_, err := m.DB.Exec("UPDATE users SET default_branch_id = ? WHERE id = ?", nullableID(branchID), id)
+	return err
+}
+
+func (m *UserModel) GetByCardNumber(cardNumber string) (*User, error) {
+	rows, err := m.DB.Query("SELECT id, name, email, created, role, COALESCE(card_number, ''), card_expires FROM users WHERE card_number = ?", cardNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users, err := scanUsers(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrNoRecord
+	}
+	return users[0], nil
+}
+
+// SetPIN sets the PIN the user types at self-service kiosks. An empty PIN
+// removes it, which stops them using kiosks.
+func (m *UserModel) SetPIN(id int, pin string) error {
+	var hash any
+	if pin != "" {
+		hashedPIN, err := bcrypt.GenerateFromPassword([]byte(pin), 12)
+		if err != nil {
+			return err
+		}
+		hash = hashedPIN
+	}
+	_, err := m.DB.Exec("UPDATE users SET pin_hash = ?, pin_failures = 0, pin_locked_until = NULL WHERE id = ?", hash, id)
+	return err
+}
 
+// Kiosk sign-in locks a card for pinLockout after pinMaxFailures wrong PINs
+// in a row.
+const (
+	pinMaxFailures = 5
+	pinLockout     = 15 * time.Minute
+)
+
+// AuthenticatePIN checks a library card number and PIN, as typed at a
+// kiosk, and returns the user's ID. Users without a PIN can't sign in this
+// way. Wrong PINs are counted per card; once the card is locked it fails
+// with ErrPINLocked, even with the right PIN, until the lockout ends.
+func (m *UserModel) AuthenticatePIN(cardNumber, pin string) (int, error) {
+	var id int
+	var hashedPIN []byte
+	var lockedUntil *time.Time
+	err := m.DB.QueryRow(
+		"SELECT id, pin_hash, pin_locked_until FROM users WHERE card_number = ? AND pin_hash IS NOT NULL", cardNumber,
+	).Scan(&id, &hashedPIN, &lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidCredentials
+		}
+		return 0, err
+	}
+	if lockedUntil != nil && lockedUntil.After(time.Now()) {
+		return 0, ErrPINLocked
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPIN, []byte(pin))
+	if err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return 0, err
+		}
+		// pin_locked_until is set first, from the count before this failure
+		_, err = m.DB.Exec(
+			`UPDATE users SET pin_locked_until = IF(pin_failures + 1 >= ?, ?, NULL),
+             pin_failures = IF(pin_failures + 1 >= ?, 0, pin_failures + 1) WHERE id = ?`,
+			pinMaxFailures, time.Now().Add(pinLockout), pinMaxFailures, id,
+		)
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrInvalidCredentials
+	}
+
+	_, err = m.DB.Exec("UPDATE users SET pin_failures = 0, pin_locked_until = NULL WHERE id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func scanUsers(rows *sql.Rows) ([]*User, error) {
 	var users []*User
 	for rows.Next() {
 		u := &User{}
-		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Role)
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Role, &u.CardNumber, &u.CardExpires)
 		if err != nil {
 			return nil, err
 		}
@@ -187,3 +368,50 @@ func (m *UserModel) ListUsers() ([]*User, error) {
 	}
 	return users, rows.Err()
 }
+
+// lockUser takes a row lock on the user for the rest of the transaction.
+func lockUser(tx *sql.Tx, userID int) error {
+	var id int
+	err := tx.QueryRow(`SELECT id FROM users WHERE id = ? FOR UPDATE`, userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoRecord
+	}
+	return err
+}
+
+// RenewMembership extends the user's membership by MembershipMonths from
+// the day it runs out, or from today if it already has.
+func (m *UserModel) RenewMembership(id int) error {
+	result, err := m.DB.Exec(
+		`UPDATE users SET card_expires = IF(? > 0, DATE_ADD(GREATEST(COALESCE(card_expires, CURDATE()), CURDATE()), INTERVAL ? MONTH), NULL)
+         WHERE id = ?`,
+		m.MembershipMonths, m.MembershipMonths, id,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		exists, err := m.Exists(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoRecord
+		}
+	}
+	return nil
+}
+
+// membershipExpired reports whether the user's membership has run out.
+func membershipExpired(q querier, userID int) (bool, error) {
+	var expired bool
+	err := q.QueryRow(
+		`SELECT COALESCE(card_expires < CURDATE(), false) FROM users WHERE id = ?`,
+		userID,
+	).Scan(&expired)
+	return expired, err
+}
@@ -9,6 +9,9 @@ import (
 // Add this regular expression for email validation.
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// PINRX matches kiosk PINs: 4 to 8 digits.
+var PINRX = regexp.MustCompile(`^[0-9]{4,8}$`)
+
 type Validator struct {
 	NonFieldErrors []string
 	FieldErrors    map[string]string
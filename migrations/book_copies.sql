@@ -0,0 +1,88 @@
+-- Moves an existing database from the total_copies/available_copies counters
+-- on books to one book_copies row per physical copy. Run once, with the app
+-- stopped, after taking a backup:
+--
+--   mysql library < migrations/book_copies.sql
+--
+-- Each book gets total_copies copies with generated barcodes (B000042-001,
+-- B000042-002, ...) matching the ones the app generates for new books. Copies
+-- are then marked on loan for each active issue and set aside for each ready
+-- hold, oldest first; the rest are available.
+--
+-- MySQL commits DDL implicitly, so this can't run as one transaction; restore
+-- the backup if it fails part way. Books with more than 1000 copies need
+-- cte_max_recursion_depth raised first.
+
+CREATE TABLE book_copies (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    book_id INTEGER NOT NULL,
+    barcode VARCHAR(32) NOT NULL,
+    location VARCHAR(100) NOT NULL DEFAULT '',
+    status ENUM('available', 'on_loan', 'on_hold', 'lost', 'damaged', 'in_repair', 'withdrawn') NOT NULL DEFAULT 'available',
+    created DATETIME NOT NULL,
+    CONSTRAINT book_copies_uc_barcode UNIQUE (barcode),
+    FOREIGN KEY (book_id) REFERENCES books(id)
+);
+
+CREATE INDEX book_copies_book_status_idx ON book_copies (book_id, status);
+
+ALTER TABLE issues ADD COLUMN copy_id INTEGER AFTER book_id, ADD FOREIGN KEY (copy_id) REFERENCES book_copies(id);
+ALTER TABLE holds ADD COLUMN copy_id INTEGER AFTER status, ADD FOREIGN KEY (copy_id) REFERENCES book_copies(id);
+
+-- N copies per book. a book can't have fewer copies than it has out, so make
+-- sure active loans and ready holds are covered too
+INSERT INTO book_copies (book_id, barcode, location, status, created)
+WITH RECURSIVE seq (n) AS (
+    SELECT 1
+    UNION ALL
+    SELECT n + 1 FROM seq WHERE n < (
+        SELECT MAX(total_copies) FROM books)
+        + (SELECT COUNT(*) FROM issues WHERE returned_at IS NULL)
+        + (SELECT COUNT(*) FROM holds WHERE status = 'ready')
+)
+SELECT b.id, CONCAT('B', LPAD(b.id, 6, '0'), '-', LPAD(seq.n, 3, '0')), '', 'available', b.created
+FROM books b
+JOIN seq ON seq.n <= GREATEST(
+    b.total_copies,
+    (SELECT COUNT(*) FROM issues i WHERE i.book_id = b.id AND i.returned_at IS NULL)
+        + (SELECT COUNT(*) FROM holds h WHERE h.book_id = b.id AND h.status = 'ready')
+);
+
+-- give the k-th active loan of each book its k-th copy, then the ready holds
+-- the copies after those
+CREATE TEMPORARY TABLE copy_assignments (
+    copy_id INTEGER NOT NULL PRIMARY KEY,
+    issue_id INTEGER,
+    hold_id INTEGER
+);
+
+INSERT INTO copy_assignments (copy_id, issue_id, hold_id)
+SELECT c.id, o.issue_id, o.hold_id
+FROM (
+    SELECT id, book_id, ROW_NUMBER() OVER (PARTITION BY book_id ORDER BY id) AS n
+    FROM book_copies
+) c
+JOIN (
+    SELECT book_id, issue_id, hold_id,
+           ROW_NUMBER() OVER (PARTITION BY book_id ORDER BY kind, created, id) AS n
+    FROM (
+        SELECT book_id, id AS issue_id, NULL AS hold_id, 1 AS kind, issued_at AS created, id
+        FROM issues WHERE returned_at IS NULL
+        UNION ALL
+        SELECT book_id, NULL, id, 2, ready_at, id
+        FROM holds WHERE status = 'ready'
+    ) outstanding
+) o ON o.book_id = c.book_id AND o.n = c.n;
+
+UPDATE issues i JOIN copy_assignments a ON a.issue_id = i.id
+SET i.copy_id = a.copy_id;
+
+UPDATE holds h JOIN copy_assignments a ON a.hold_id = h.id
+SET h.copy_id = a.copy_id;
+
+UPDATE book_copies c JOIN copy_assignments a ON a.copy_id = c.id
+SET c.status = IF(a.issue_id IS NOT NULL, 'on_loan', 'on_hold');
+
+DROP TEMPORARY TABLE copy_assignments;
+
+ALTER TABLE books DROP COLUMN total_copies, DROP COLUMN available_copies;
@@ -1,3 +1,13 @@
+-- library sites; every copy has a home branch
+CREATE TABLE branches (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT branches_uc_name UNIQUE (name)
+);
+
+INSERT INTO branches (id, name, created) VALUES (1, 'Main Library', NOW());
+
 CREATE TABLE users (
     id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
     name VARCHAR(255) NOT NULL,
@@ -5,7 +15,30 @@ CREATE TABLE users (
     hashed_password CHAR(60) NOT NULL,
     created DATETIME NOT NULL,
     role ENUM('student', 'librarian', 'admin') NOT NULL DEFAULT 'student',
-    CONSTRAINT users_uc_email UNIQUE (email)
+    card_number VARCHAR(32),
+    -- last day of the membership; NULL if it never expires
+    card_expires DATE,
+    -- when false, returned loans are anonymised instead of kept as history
+    keep_history BOOLEAN NOT NULL DEFAULT true,
+    -- bcrypt hash of the PIN used to sign in at self-service kiosks
+    pin_hash CHAR(60),
+    -- wrong kiosk PINs in a row, and when the lockout they caused ends
+    pin_failures INTEGER NOT NULL DEFAULT 0,
+    pin_locked_until DATETIME,
+    -- the branch a patron borrows from, or the branch staff are working at
+    default_branch_id INTEGER,
+    CONSTRAINT users_uc_email UNIQUE (email),
+    CONSTRAINT users_uc_card_number UNIQUE (card_number),
+    FOREIGN KEY (default_branch_id) REFERENCES branches(id)
+);
+
+-- the branches each librarian manages; admins manage every branch
+CREATE TABLE librarian_branches (
+    user_id INTEGER NOT NULL,
+    branch_id INTEGER NOT NULL,
+    PRIMARY KEY (user_id, branch_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (branch_id) REFERENCES branches(id)
 );
 
 CREATE TABLE sessions (
@@ -16,28 +49,436 @@ CREATE TABLE sessions (
 
 CREATE INDEX sessions_expiry_idx ON sessions (expiry);
 
+-- how books circulate. loan_days overrides the loan policy's period when set;
+-- reference items aren't loanable at all
+CREATE TABLE item_types (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(50) NOT NULL,
+    loanable BOOLEAN NOT NULL DEFAULT true,
+    loan_days INTEGER,
+    CONSTRAINT item_types_uc_name UNIQUE (name)
+);
+
+INSERT INTO item_types (id, name, loanable, loan_days) VALUES
+(1, 'Regular', true, NULL),
+(2, 'Reference', false, NULL),
+(3, 'Short loan', true, 2),
+(4, 'Media', true, 3);
+
 CREATE TABLE books (
     id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
     title VARCHAR(255) NOT NULL,
     author VARCHAR(255) NOT NULL,
     isbn VARCHAR(20) NOT NULL,
-    total_copies INTEGER NOT NULL DEFAULT 1,
-    available_copies INTEGER NOT NULL DEFAULT 1,
+    -- charged when a copy is lost or damaged on loan, in cents
+    replacement_cost INTEGER NOT NULL DEFAULT 0,
+    item_type_id INTEGER NOT NULL DEFAULT 1,
     created DATETIME NOT NULL,
-    CONSTRAINT books_uc_isbn UNIQUE (isbn)
+    -- set when the book is taken out of the catalogue; its history is kept
+    withdrawn_at DATETIME,
+    CONSTRAINT books_uc_isbn UNIQUE (isbn),
+    FOREIGN KEY (item_type_id) REFERENCES item_types(id)
+);
+
+-- physical copies (items) of a book. availability is derived from status
+CREATE TABLE book_copies (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    book_id INTEGER NOT NULL,
+    -- home branch
+    branch_id INTEGER NOT NULL,
+    barcode VARCHAR(32) NOT NULL,
+    location VARCHAR(100) NOT NULL DEFAULT '',
+    status ENUM('available', 'on_loan', 'on_hold', 'lost', 'damaged', 'in_repair', 'withdrawn', 'in_transit') NOT NULL DEFAULT 'available',
+    -- overrides books.replacement_cost when set
+    replacement_cost INTEGER,
+    created DATETIME NOT NULL,
+    CONSTRAINT book_copies_uc_barcode UNIQUE (barcode),
+    FOREIGN KEY (book_id) REFERENCES books(id),
+    FOREIGN KEY (branch_id) REFERENCES branches(id)
+);
+
+CREATE INDEX book_copies_book_status_idx ON book_copies (book_id, status);
+
+-- copies returned at another branch on their way home. received_at is set
+-- when the home branch scans the copy in
+CREATE TABLE transfers (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    copy_id INTEGER NOT NULL,
+    from_branch_id INTEGER NOT NULL,
+    to_branch_id INTEGER NOT NULL,
+    sent_at DATETIME NOT NULL,
+    sent_by INTEGER,
+    received_at DATETIME,
+    received_by INTEGER,
+    FOREIGN KEY (copy_id) REFERENCES book_copies(id),
+    FOREIGN KEY (from_branch_id) REFERENCES branches(id),
+    FOREIGN KEY (to_branch_id) REFERENCES branches(id),
+    FOREIGN KEY (sent_by) REFERENCES users(id),
+    FOREIGN KEY (received_by) REFERENCES users(id)
+);
+
+CREATE INDEX transfers_received_sent_idx ON transfers (received_at, sent_at);
+
+-- borrowing rules per role
+CREATE TABLE loan_policies (
+    role ENUM('student', 'librarian', 'admin') NOT NULL PRIMARY KEY,
+    loan_days INTEGER NOT NULL,
+    max_loans INTEGER NOT NULL,
+    max_renewals INTEGER NOT NULL,
+    grace_days INTEGER NOT NULL,
+    -- a recalled loan still runs at least this many days from its issue date
+    recall_min_days INTEGER NOT NULL DEFAULT 7
+);
+
+INSERT INTO loan_policies (role, loan_days, max_loans, max_renewals, grace_days, recall_min_days) VALUES
+    ('student', 14, 5, 2, 3, 7),
+    ('librarian', 28, 10, 3, 7, 7),
+    ('admin', 28, 10, 3, 7, 7);
+
+-- weekly opening days, 0 = Sunday. due dates roll forward past closed days
+CREATE TABLE opening_days (
+    weekday TINYINT NOT NULL PRIMARY KEY,
+    is_open BOOLEAN NOT NULL
+);
+
+INSERT INTO opening_days (weekday, is_open) VALUES
+    (0, false), (1, true), (2, true), (3, true), (4, true), (5, true), (6, true);
+
+-- one-off closures such as public holidays and exam breaks, inclusive
+CREATE TABLE closures (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    starts_on DATE NOT NULL,
+    ends_on DATE NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL
+);
+
+CREATE INDEX closures_ends_on_idx ON closures (ends_on);
+
+-- self-service kiosks; only a SHA-256 hash of each device key is stored
+CREATE TABLE kiosk_devices (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    branch_id INTEGER NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    last_seen DATETIME,
+    revoked_at DATETIME,
+    CONSTRAINT kiosk_devices_uc_key_hash UNIQUE (key_hash),
+    FOREIGN KEY (branch_id) REFERENCES branches(id)
+);
+
+-- course reserves: books set aside for a course until the end of term and
+-- lent on a short loan. loan_hours 0 means overnight
+CREATE TABLE course_reserves (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    course_code VARCHAR(20) NOT NULL,
+    instructor VARCHAR(255) NOT NULL,
+    term VARCHAR(50) NOT NULL,
+    ends_on DATE NOT NULL,
+    loan_hours INTEGER NOT NULL,
+    created DATETIME NOT NULL
+);
+
+CREATE INDEX course_reserves_ends_on_idx ON course_reserves (ends_on);
+
+CREATE TABLE course_reserve_books (
+    reserve_id INTEGER NOT NULL,
+    book_id INTEGER NOT NULL,
+    PRIMARY KEY (reserve_id, book_id),
+    FOREIGN KEY (reserve_id) REFERENCES course_reserves(id),
+    FOREIGN KEY (book_id) REFERENCES books(id)
 );
 
 -- tracks book issues
 CREATE TABLE issues (
     id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
     book_id INTEGER NOT NULL,
-    user_id INTEGER NOT NULL,
+    copy_id INTEGER,
+    -- NULL once a returned loan has been anonymised
+    user_id INTEGER,
     issued_at DATETIME NOT NULL,
     due_date DATETIME NOT NULL,
     returned_at DATETIME,
+    renewal_count INTEGER NOT NULL DEFAULT 0,
+    max_renewals INTEGER NOT NULL DEFAULT 0,
+    issued_by INTEGER,
+    returned_by INTEGER,
+    condition_note VARCHAR(255) NOT NULL DEFAULT '',
+    -- set when the loan was closed by declaring the copy lost or damaged
+    loss ENUM('lost', 'damaged'),
+    -- set when staff recall the loan early; recalled loans can't be renewed
+    recalled_at DATETIME,
+    recalled_by INTEGER,
+    recall_requested_by VARCHAR(255) NOT NULL DEFAULT '',
+    -- the kiosk a self-service loan was issued or returned at
+    issued_kiosk_id INTEGER,
+    returned_kiosk_id INTEGER,
+    -- the branch that lent the book and the one it came back to
+    issued_branch_id INTEGER,
+    returned_branch_id INTEGER,
+    -- the course reserve that set a short loan period
+    reserve_id INTEGER,
+    FOREIGN KEY (book_id) REFERENCES books(id),
+    FOREIGN KEY (copy_id) REFERENCES book_copies(id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (issued_by) REFERENCES users(id),
+    FOREIGN KEY (returned_by) REFERENCES users(id),
+    FOREIGN KEY (recalled_by) REFERENCES users(id),
+    FOREIGN KEY (issued_kiosk_id) REFERENCES kiosk_devices(id),
+    FOREIGN KEY (returned_kiosk_id) REFERENCES kiosk_devices(id),
+    FOREIGN KEY (issued_branch_id) REFERENCES branches(id),
+    FOREIGN KEY (returned_branch_id) REFERENCES branches(id),
+    FOREIGN KEY (reserve_id) REFERENCES course_reserves(id)
+);
+
+-- one row per renewal of a loan
+CREATE TABLE issue_renewals (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    issue_id INTEGER NOT NULL,
+    renewed_at DATETIME NOT NULL,
+    previous_due_date DATETIME NOT NULL,
+    new_due_date DATETIME NOT NULL,
+    FOREIGN KEY (issue_id) REFERENCES issues(id)
+);
+
+-- hold queue: patrons waiting for a copy of a book, served oldest first
+CREATE TABLE holds (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    book_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    status ENUM('waiting', 'ready', 'fulfilled', 'cancelled', 'expired') NOT NULL DEFAULT 'waiting',
+    -- the copy set aside while the hold is ready
+    copy_id INTEGER,
+    created DATETIME NOT NULL,
+    ready_at DATETIME,
+    expires_at DATETIME,
+    closed_at DATETIME,
+    FOREIGN KEY (book_id) REFERENCES books(id),
+    FOREIGN KEY (copy_id) REFERENCES book_copies(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX holds_book_status_idx ON holds (book_id, status, created);
+
+-- patrons waiting to hear when a book is back on the shelf. removed once
+-- they've been notified
+CREATE TABLE book_subscriptions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    book_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT book_subscriptions_uc_book_user UNIQUE (book_id, user_id),
     FOREIGN KEY (book_id) REFERENCES books(id),
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- charges owed by patrons, e.g. for overdue returns. amounts are in cents
+CREATE TABLE fines (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    issue_id INTEGER,
+    kind ENUM('overdue', 'replacement') NOT NULL,
+    days_late INTEGER NOT NULL DEFAULT 0,
+    amount INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (issue_id) REFERENCES issues(id)
+);
+
+-- payments ledger: every payment or waiver against a fine
+CREATE TABLE fine_payments (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    fine_id INTEGER NOT NULL,
+    kind ENUM('payment', 'waiver', 'refund') NOT NULL,
+    amount INTEGER NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    staff_id INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (fine_id) REFERENCES fines(id),
+    FOREIGN KEY (staff_id) REFERENCES users(id)
+);
+
+-- messages to patrons, e.g. overdue notices
+CREATE TABLE notifications (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    issue_id INTEGER,
+    message VARCHAR(500) NOT NULL,
+    created DATETIME NOT NULL,
+    read_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (issue_id) REFERENCES issues(id)
+);
+
+CREATE INDEX notifications_user_idx ON notifications (user_id, created);
+
+-- suspensions of a patron's borrowing, active until lifted
+CREATE TABLE patron_blocks (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    -- the staff member who added the block; NULL for the overdue processor
+    created_by INTEGER,
+    lifted_at DATETIME,
+    lifted_by INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (created_by) REFERENCES users(id),
+    FOREIGN KEY (lifted_by) REFERENCES users(id)
+);
+
+-- books patrons have asked the library to buy, and the orders placed for
+-- them. cost is in cents
+CREATE TABLE purchase_suggestions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    author VARCHAR(255) NOT NULL,
+    isbn VARCHAR(20) NOT NULL DEFAULT '',
+    status ENUM('pending', 'approved', 'rejected', 'ordered', 'received') NOT NULL DEFAULT 'pending',
+    -- why it was rejected, shown to the patron
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    vendor VARCHAR(255) NOT NULL DEFAULT '',
+    cost INTEGER NOT NULL DEFAULT 0,
+    expected_on DATE,
+    ordered_at DATETIME,
+    received_at DATETIME,
+    -- the catalogue book made when the order arrived
+    book_id INTEGER,
+    -- the staff member who last moved the suggestion on
+    reviewed_by INTEGER,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (book_id) REFERENCES books(id),
+    FOREIGN KEY (reviewed_by) REFERENCES users(id)
+);
+
+CREATE INDEX purchase_suggestions_status_idx ON purchase_suggestions (status, created);
+
+-- acquisitions budget per calendar year, in cents
+CREATE TABLE acquisition_budgets (
+    year INTEGER NOT NULL PRIMARY KEY,
+    amount INTEGER NOT NULL
+);
+
+-- staff-only remarks on a patron's account
+CREATE TABLE patron_notes (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    staff_id INTEGER NOT NULL,
+    note VARCHAR(1000) NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (staff_id) REFERENCES users(id)
+);
+
+-- one row per run of a background job
+CREATE TABLE job_runs (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    job VARCHAR(50) NOT NULL,
+    started_at DATETIME NOT NULL,
+    finished_at DATETIME,
+    processed INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    error VARCHAR(1000) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX job_runs_job_idx ON job_runs (job, started_at);
+
+-- overdue notices sent by the overdue processor, at most one per level per loan
+CREATE TABLE overdue_notices (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    issue_id INTEGER NOT NULL,
+    run_id INTEGER NOT NULL,
+    level ENUM('first', 'second', 'final') NOT NULL,
+    days_overdue INTEGER NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT overdue_notices_uc_issue_level UNIQUE (issue_id, level),
+    FOREIGN KEY (issue_id) REFERENCES issues(id),
+    FOREIGN KEY (run_id) REFERENCES job_runs(id)
+);
+
 -- alter existing users table to add role (run this if table already exists)
 -- ALTER TABLE users ADD COLUMN role ENUM('student', 'librarian', 'admin') NOT NULL DEFAULT 'student';
+
+-- alter existing issues table to add renewals (run this if table already exists)
+-- ALTER TABLE issues ADD COLUMN renewal_count INTEGER NOT NULL DEFAULT 0, ADD COLUMN max_renewals INTEGER NOT NULL DEFAULT 0;
+
+-- library card numbers and desk checkout (run this if tables already exist)
+-- ALTER TABLE users ADD COLUMN card_number VARCHAR(32), ADD CONSTRAINT users_uc_card_number UNIQUE (card_number);
+-- ALTER TABLE issues ADD COLUMN issued_by INTEGER, ADD FOREIGN KEY (issued_by) REFERENCES users(id);
+
+-- staff check-in (run this if the issues table already exists)
+-- ALTER TABLE issues ADD COLUMN returned_by INTEGER, ADD COLUMN condition_note VARCHAR(255) NOT NULL DEFAULT '', ADD FOREIGN KEY (returned_by) REFERENCES users(id);
+
+-- per-copy item records replace books.total_copies/available_copies. existing
+-- databases need the data migration in migrations/book_copies.sql
+
+-- lost and damaged items (run this if the tables already exist)
+-- ALTER TABLE books ADD COLUMN replacement_cost INTEGER NOT NULL DEFAULT 0 AFTER isbn;
+-- ALTER TABLE book_copies ADD COLUMN replacement_cost INTEGER AFTER status;
+-- ALTER TABLE issues ADD COLUMN loss ENUM('lost', 'damaged') AFTER condition_note;
+-- ALTER TABLE fines MODIFY kind ENUM('overdue', 'replacement') NOT NULL;
+-- ALTER TABLE fine_payments MODIFY kind ENUM('payment', 'waiver', 'refund') NOT NULL;
+
+-- library calendar: create the opening_days and closures tables above, with the
+-- opening_days seed rows
+
+-- overdue notices: create the notifications, patron_blocks, job_runs and
+-- overdue_notices tables above
+
+-- recalls (run this if the tables already exist)
+-- ALTER TABLE loan_policies ADD COLUMN recall_min_days INTEGER NOT NULL DEFAULT 7;
+-- ALTER TABLE issues ADD COLUMN recalled_at DATETIME, ADD COLUMN recalled_by INTEGER, ADD COLUMN recall_requested_by VARCHAR(255) NOT NULL DEFAULT '', ADD FOREIGN KEY (recalled_by) REFERENCES users(id);
+
+-- borrowing history (run this if the tables already exist)
+-- ALTER TABLE users ADD COLUMN keep_history BOOLEAN NOT NULL DEFAULT true;
+-- ALTER TABLE issues MODIFY user_id INTEGER;
+
+-- withdrawn books (run this if the books table already exists)
+-- ALTER TABLE books ADD COLUMN withdrawn_at DATETIME;
+
+-- self-service kiosks: create the kiosk_devices table above, then
+-- ALTER TABLE users ADD COLUMN pin_hash CHAR(60);
+-- ALTER TABLE issues ADD COLUMN issued_kiosk_id INTEGER, ADD COLUMN returned_kiosk_id INTEGER, ADD FOREIGN KEY (issued_kiosk_id) REFERENCES kiosk_devices(id), ADD FOREIGN KEY (returned_kiosk_id) REFERENCES kiosk_devices(id);
+
+-- branches: create the branches table above with its seed row, then put
+-- everything existing in the main library
+-- ALTER TABLE users ADD COLUMN default_branch_id INTEGER, ADD FOREIGN KEY (default_branch_id) REFERENCES branches(id);
+-- CREATE TABLE librarian_branches (see above);
+-- INSERT INTO librarian_branches (user_id, branch_id) SELECT id, 1 FROM users WHERE role = 'librarian';
+-- ALTER TABLE book_copies ADD COLUMN branch_id INTEGER NOT NULL DEFAULT 1 AFTER book_id, ADD FOREIGN KEY (branch_id) REFERENCES branches(id);
+-- ALTER TABLE kiosk_devices ADD COLUMN branch_id INTEGER NOT NULL DEFAULT 1 AFTER name, ADD FOREIGN KEY (branch_id) REFERENCES branches(id);
+-- ALTER TABLE issues ADD COLUMN issued_branch_id INTEGER, ADD COLUMN returned_branch_id INTEGER, ADD FOREIGN KEY (issued_branch_id) REFERENCES branches(id), ADD FOREIGN KEY (returned_branch_id) REFERENCES branches(id);
+
+-- transfers: create the transfers table above, then
+-- ALTER TABLE book_copies MODIFY status ENUM('available', 'on_loan', 'on_hold', 'lost', 'damaged', 'in_repair', 'withdrawn', 'in_transit') NOT NULL DEFAULT 'available';
+
+-- course reserves: create the course_reserves and course_reserve_books tables
+-- above, then
+-- ALTER TABLE issues ADD COLUMN reserve_id INTEGER, ADD FOREIGN KEY (reserve_id) REFERENCES course_reserves(id);
+
+-- item types: create the item_types table above with its seed rows, then
+-- ALTER TABLE books ADD COLUMN item_type_id INTEGER NOT NULL DEFAULT 1 AFTER replacement_cost, ADD FOREIGN KEY (item_type_id) REFERENCES item_types(id);
+
+-- notify me: create the book_subscriptions table above
+
+-- memberships and blocks (run this if the tables already exist; existing
+-- users keep memberships that never expire)
+-- ALTER TABLE users ADD COLUMN card_expires DATE AFTER card_number;
+-- ALTER TABLE patron_blocks ADD COLUMN created_by INTEGER AFTER created, ADD FOREIGN KEY (created_by) REFERENCES users(id);
+
+-- patron accounts: create the patron_notes table above
+
+-- acquisitions: create the purchase_suggestions and acquisition_budgets
+-- tables above
+
+-- failed records in job runs (run this if the job_runs table already exists)
+-- ALTER TABLE job_runs ADD COLUMN failed INTEGER NOT NULL DEFAULT 0 AFTER processed;
+
+-- loan messages (run this if the notifications table already exists)
+-- ALTER TABLE notifications ADD COLUMN issue_id INTEGER AFTER user_id, ADD FOREIGN KEY (issue_id) REFERENCES issues(id);
+
+-- kiosk PIN lockout (run this if the users table already exists)
+-- ALTER TABLE users ADD COLUMN pin_failures INTEGER NOT NULL DEFAULT 0 AFTER pin_hash, ADD COLUMN pin_locked_until DATETIME AFTER pin_failures;
@@ -0,0 +1,63 @@
+// Circulation screen. A USB barcode scanner types the code followed by Enter,
+// which submits the form; each scan is posted in the background and the
+// server's HTML response is put into the page, so the scanner can keep going
+// without waiting for page loads. The forms carry the usual csrf_token field.
+document.addEventListener("DOMContentLoaded", function () {
+    var patronForm = document.getElementById("patron-form");
+    var itemForm = document.getElementById("item-form");
+    var patronPanel = document.getElementById("patron-panel");
+    var log = document.getElementById("circulation-log");
+    var cardInput = patronForm.elements["card_number"];
+    var itemInput = itemForm.elements["item"];
+
+    function post(form) {
+        return fetch(form.action, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {"Content-Type": "application/x-www-form-urlencoded"},
+            body: new URLSearchParams(new FormData(form)),
+        }).then(function (resp) {
+            if (!resp.ok) {
+                throw new Error(resp.status + " " + resp.statusText);
+            }
+            return resp.text();
+        });
+    }
+
+    // failedRow records a scan the server never answered, e.g. because the
+    // session expired.
+    function failedRow(item, err) {
+        var row = document.createElement("tr");
+        row.className = "scan-error";
+        var cells = [new Date().toTimeString().slice(0, 8), "", item, "", "", "Not processed: " + err.message];
+        cells.forEach(function (text) {
+            var td = document.createElement("td");
+            td.textContent = text;
+            row.appendChild(td);
+        });
+        return row;
+    }
+
+    patronForm.addEventListener("submit", function (e) {
+        e.preventDefault();
+        post(patronForm).then(function (html) {
+            patronPanel.innerHTML = html;
+        }).catch(function (err) {
+            patronPanel.textContent = "Couldn't look up the card: " + err.message;
+        });
+        cardInput.value = "";
+        itemInput.focus();
+    });
+
+    itemForm.addEventListener("submit", function (e) {
+        e.preventDefault();
+        var item = itemInput.value;
+        post(itemForm).then(function (html) {
+            log.insertAdjacentHTML("afterbegin", html);
+        }).catch(function (err) {
+            log.insertBefore(failedRow(item, err), log.firstChild);
+        });
+        itemInput.value = "";
+        itemInput.focus();
+    });
+});